@@ -1,11 +1,23 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"container/heap"
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"math/bits"
+	"math/rand"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -19,8 +31,8 @@ const (
 	playerEntity         = 0
 	bombEntity           = 1
 	itemEntity           = 2
-	nbCols               = 13
-	nbRows               = 11
+	maxCols              = 15 // largest grid the bitboards can hold
+	maxRows              = 15
 	box                  = '0'
 	boxWithExtraRange    = '1'
 	boxWithExtraBomb     = '2'
@@ -35,8 +47,19 @@ const (
 	move                 = 0
 	dropBomb             = 1
 	timeoutLimit         = 60
+	itemMaxUsefulRange   = 6  // extra range items are worthless from this range
+	itemMaxUsefulBombs   = 4  // extra bomb items are worthless from this number of bombs
+	attackBoxThreshold   = 10 // attack mode is on below this number of boxes
+	threatHorizon        = 2  // number of turns during which opponent bomb drops are checked
+	pruneHorizon         = 4  // number of turns during which moves without escape are pruned
 )
 
+// size of the grid, read from the first line of the input
+var nbCols, nbRows int = 13, 11
+
+// players of the game, the ones listed in the first turn input
+var nbPlayers int = maxPlayers
+
 var cardinalVectors [nbCardinalDirections]Position = [nbCardinalDirections]Position{Position{0, 1}, Position{0, -1}, Position{1, 0}, Position{-1, 0}}
 
 func Min(a, b int) int {
@@ -53,6 +76,12 @@ func Max(a, b int) int {
 		return b
 	}
 }
+func abs(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
 
 type Position struct {
 	x, y int
@@ -74,244 +103,358 @@ type Player struct {
 	remainingBombs  int
 	bombRange       int
 	isDead          bool
+	inDanger        bool // an opponent bomb drop could leave no escape route
 	score           int
 	potential       int
 	scorePerTurn    int
 	potPerTurn      int
 	lastScoreUpdate int
 	lastPotUpdate   int
+	itemsPicked     int
+	trapsSet        int // bombs cutting all the escape routes of an opponent, counted per opponent
 }
 
 func (p Player) String() string {
-	return fmt.Sprintf("[s=%v d=%v nbb=%v rng=%v]", p.score, p.isDead, p.remainingBombs, p.bombRange)
+	return fmt.Sprintf("[s=%v d=%v dgr=%v nbb=%v rng=%v]", p.score, p.isDead, p.inDanger, p.remainingBombs, p.bombRange)
 }
 
 type Bomb struct {
 	Position
-	ownerID int
+	ownerID   int
+	timer     int // rounds left before the explosion
+	bombRange int
 }
 
 func (b Bomb) String() string {
-	return fmt.Sprintf("%v:%v", b.ownerID, b.Position)
-}
-
-type Cell int16
-
-// prevent player from walking:
-// bit : bomb from player 0
-// bit : bomb from player 1
-// bit : bomb from player 2
-// bit : bomb from player 3
-// bit : wall
-// bit : box without item
-// bit : box with item type 1 extra range
-// bit : box with item type 2 extra bomb
-//
-// don't prevent players from walking:
-// bit : player 0
-// bit : player 1
-// bit : player 2
-// bit : player 3
-// bit : item type 1 extra range
-// bit : item type 2 extra bomb
+	return fmt.Sprintf("%v:%v:%v", b.ownerID, b.Position, b.timer)
+}
+
+/* Bitboards: one bit per cell, row after row.
+ * Each row has a guard bit at its end so that shifting a board by one cell
+ * east or west never wraps to the next row.
+ * The boards are sized for the largest grid: the cells beyond the actual
+ * grid are never set. */
 const (
-	bombPlayer0Bit    = 01
-	bombPlayer1Bit    = 02
-	bombPlayer2Bit    = 04
-	bombPlayer3Bit    = 010
-	wallBit           = 020
-	boxWithoutItemBit = 040
-	boxWithItem1Bit   = 0100
-	boxWithItem2Bit   = 0200
-	player0Bit        = 0400
-	player1Bit        = 01000
-	player2Bit        = 02000
-	player3Bit        = 04000
-	item1Bit          = 010000
-	item2Bit          = 020000
-
-	inaccessibleBits = 0377
-	boxBits          = 0340
-	bombBits         = 017
-	playerBits       = 07400
-	itemBits         = 030000
-	inflamableBits   = 037757
+	bbStride = maxCols + 1
+	bbWords  = (maxRows*bbStride + 63) / 64
 )
 
-func (c *Cell) Burn() {
-	*c &^= inflamableBits
-}
-
-func (c *Cell) SetBomb(playerId int) {
-	switch playerId {
-	case 0:
-		*c |= bombPlayer0Bit
-	case 1:
-		*c |= bombPlayer1Bit
-	case 2:
-		*c |= bombPlayer2Bit
-	case 3:
-		*c |= bombPlayer3Bit
-	}
-}
-func (c *Cell) ResetBomb(playerId int) {
-	switch playerId {
-	case 0:
-		*c &^= bombPlayer0Bit
-	case 1:
-		*c &^= bombPlayer1Bit
-	case 2:
-		*c &^= bombPlayer2Bit
-	case 3:
-		*c &^= bombPlayer3Bit
-	}
-}
-func (c *Cell) SetPlayer(playerId int) {
-	switch playerId {
-	case 0:
-		*c |= player0Bit
-	case 1:
-		*c |= player1Bit
-	case 2:
-		*c |= player2Bit
-	case 3:
-		*c |= player3Bit
-	}
-}
-func (c *Cell) ResetPlayer(playerId int) {
-	switch playerId {
-	case 0:
-		*c &^= player0Bit
-	case 1:
-		*c &^= player1Bit
-	case 2:
-		*c &^= player2Bit
-	case 3:
-		*c &^= player3Bit
-	}
-}
-func (c *Cell) SetWall() {
-	*c |= wallBit
-}
-func (c *Cell) ResetWall() {
-	*c &^= wallBit
-}
-func (c *Cell) SetBox(itemType int) {
-	switch itemType {
-	case itemNone:
-		*c |= boxWithoutItemBit
-	case itemExtraRange:
-		*c |= boxWithItem1Bit
-	case itemExtraBomb:
-		*c |= boxWithItem2Bit
+type Bitboard [bbWords]uint64
+
+var onGrid Bitboard = GridCells()
+
+func GridCells() (b Bitboard) {
+	for y := 0; y < nbRows; y++ {
+		for x := 0; x < nbCols; x++ {
+			b.Set(Position{x, y}.index())
+		}
+	}
+	return
+}
+
+func SetGridSize(width, height int) error {
+	if width <= 0 || height <= 0 || width > maxCols || height > maxRows {
+		return fmt.Errorf("grid of %vx%v, at most %vx%v supported", width, height, maxCols, maxRows)
+	}
+	nbCols, nbRows = width, height
+	onGrid = GridCells()
+	return nil
+}
+
+func SetPlayerCount(count int) error {
+	if count <= 0 || count > maxPlayers {
+		return fmt.Errorf("%v players, at most %v supported", count, maxPlayers)
+	}
+	nbPlayers = count
+	return nil
+}
+
+var cardinalShifts [nbCardinalDirections]int = [nbCardinalDirections]int{bbStride, -bbStride, 1, -1}
+
+func (p Position) index() int {
+	return p.y*bbStride + p.x
+}
+
+func (b *Bitboard) Set(idx int) {
+	b[idx/64] |= 1 << uint(idx%64)
+}
+func (b *Bitboard) Reset(idx int) {
+	b[idx/64] &^= 1 << uint(idx%64)
+}
+func (b Bitboard) Has(idx int) bool {
+	return b[idx/64]&(1<<uint(idx%64)) != 0
+}
+func (b Bitboard) IsZero() bool {
+	for _, w := range b {
+		if w != 0 {
+			return false
+		}
+	}
+	return true
+}
+func (b Bitboard) Count() (count int) {
+	for _, w := range b {
+		count += bits.OnesCount64(w)
+	}
+	return
+}
+func (b Bitboard) Or(b2 Bitboard) Bitboard {
+	for i := range b {
+		b[i] |= b2[i]
+	}
+	return b
+}
+func (b Bitboard) And(b2 Bitboard) Bitboard {
+	for i := range b {
+		b[i] &= b2[i]
+	}
+	return b
+}
+func (b Bitboard) AndNot(b2 Bitboard) Bitboard {
+	for i := range b {
+		b[i] &^= b2[i]
+	}
+	return b
+}
+
+// Moves every cell n indexes further (backwards if n < 0), dropping the
+// cells that leave the grid.
+func (b Bitboard) Shift(n int) (r Bitboard) {
+	if n >= 0 {
+		w, s := n/64, uint(n%64)
+		for i := bbWords - 1; i >= w; i-- {
+			r[i] = b[i-w] << s
+			if s > 0 && i-w > 0 {
+				r[i] |= b[i-w-1] >> (64 - s)
+			}
+		}
+	} else {
+		w, s := -n/64, uint(-n%64)
+		for i := 0; i+w < bbWords; i++ {
+			r[i] = b[i+w] >> s
+			if s > 0 && i+w+1 < bbWords {
+				r[i] |= b[i+w+1] << (64 - s)
+			}
+		}
+	}
+	return r.And(onGrid)
+}
+
+func (b Bitboard) Positions() (positions []Position) {
+	for y := 0; y < nbRows; y++ {
+		for x := 0; x < nbCols; x++ {
+			if b.Has(Position{x, y}.index()) {
+				positions = append(positions, Position{x, y})
+			}
+		}
+	}
+	return
+}
+
+func (b Bitboard) String() string {
+	return fmt.Sprintf("%v", b.Positions())
+}
+
+/* An item under a box is the item bit with the box bit, a visible item is the
+ * item bit alone: burning a box reveals its item for free.
+ * A cell holds one bomb at most: its owner is written in binary over the
+ * bombOwners boards. A player is on one cell only: it is kept as its index,
+ * plus one so that the zero grid has nobody on it. */
+const bombOwnerBits = 2 // enough for maxPlayers owners
+
+type Grid struct {
+	walls       Bitboard
+	boxes       Bitboard
+	rangeItems  Bitboard
+	bombItems   Bitboard
+	bombs       Bitboard
+	bombOwners  [bombOwnerBits]Bitboard
+	playerCells [maxPlayers]uint8
+}
+
+// cells stopping the blasts, players don't
+func (g *Grid) obstacles() (b Bitboard) {
+	return g.walls.Or(g.boxes).Or(g.rangeItems).Or(g.bombItems).Or(g.bombs)
+}
+
+func (g *Grid) bombOwner(idx int) (owner int) {
+	for bit := range g.bombOwners {
+		if g.bombOwners[bit].Has(idx) {
+			owner |= 1 << uint(bit)
+		}
+	}
+	return
+}
+
+func (g *Grid) hasPlayer(playerId int, idx int) bool {
+	return int(g.playerCells[playerId]) == idx+1
+}
+
+func (g *Grid) playerIn(playerId int, cells Bitboard) bool {
+	return g.playerCells[playerId] != 0 && cells.Has(int(g.playerCells[playerId])-1)
+}
+
+func (g *Grid) accessible() Bitboard {
+	return onGrid.AndNot(g.walls.Or(g.boxes).Or(g.bombs))
+}
+
+// burns everything but the walls
+func (g *Grid) burn(cells Bitboard) {
+	g.rangeItems = g.rangeItems.AndNot(cells.AndNot(g.boxes))
+	g.bombItems = g.bombItems.AndNot(cells.AndNot(g.boxes))
+	g.boxes = g.boxes.AndNot(cells)
+	g.bombs = g.bombs.AndNot(cells)
+	for bit := range g.bombOwners {
+		g.bombOwners[bit] = g.bombOwners[bit].AndNot(cells)
+	}
+	for i := 0; i < nbPlayers; i++ {
+		if g.playerIn(i, cells) {
+			g.playerCells[i] = 0
+		}
+	}
+}
+
+/* Cell is a view over one cell of the grid bitboards */
+type Cell struct {
+	grid *Grid
+	idx  int
+}
+
+func (c Cell) Burn() {
+	var cells Bitboard
+	cells.Set(c.idx)
+	c.grid.burn(cells)
+}
+
+func (c Cell) SetBomb(playerId int) {
+	c.grid.bombs.Set(c.idx)
+	for bit := range c.grid.bombOwners {
+		if playerId&(1<<uint(bit)) != 0 {
+			c.grid.bombOwners[bit].Set(c.idx)
+		} else {
+			c.grid.bombOwners[bit].Reset(c.idx)
+		}
+	}
+}
+func (c Cell) ResetBomb(playerId int) {
+	if !c.isBomb() || c.grid.bombOwner(c.idx) != playerId {
+		return
+	}
+	c.grid.bombs.Reset(c.idx)
+	for bit := range c.grid.bombOwners {
+		c.grid.bombOwners[bit].Reset(c.idx)
+	}
+}
+func (c Cell) SetPlayer(playerId int) {
+	c.grid.playerCells[playerId] = uint8(c.idx + 1)
+}
+func (c Cell) ResetPlayer(playerId int) {
+	if c.grid.hasPlayer(playerId, c.idx) {
+		c.grid.playerCells[playerId] = 0
 	}
 }
-func (c *Cell) ResetBox() {
-	*c &^= boxBits
+func (c Cell) SetWall() {
+	c.grid.walls.Set(c.idx)
+}
+func (c Cell) ResetWall() {
+	c.grid.walls.Reset(c.idx)
+}
+func (c Cell) SetBox(itemType int) {
+	c.grid.boxes.Set(c.idx)
+	c.SetItem(itemType)
+}
+func (c Cell) ResetBox() {
+	c.grid.boxes.Reset(c.idx)
+	c.ResetItem()
 }
 
-func (c *Cell) SetItem(itemType int) {
+func (c Cell) SetItem(itemType int) {
 	switch itemType {
 	case itemExtraRange:
-		*c |= item1Bit
+		c.grid.rangeItems.Set(c.idx)
 	case itemExtraBomb:
-		*c |= item2Bit
+		c.grid.bombItems.Set(c.idx)
 	}
 }
-func (c *Cell) ResetItem() {
-	*c &^= itemBits
+func (c Cell) ResetItem() {
+	c.grid.rangeItems.Reset(c.idx)
+	c.grid.bombItems.Reset(c.idx)
 }
 
 func (c Cell) isEmpty() bool {
-	return c == 0
+	return !c.isWall() && !c.isBox() && c.getItemType() == itemNone && !c.isBomb() && !c.isPlayer()
+}
+func (c Cell) stopsBlasts() bool {
+	// like the explosions: the blasts go through the players
+	return c.isWall() || c.isBox() || c.getItemType() != itemNone || c.isBomb()
 }
 func (c Cell) CanReceiveBombNow() bool {
 	//assumes that player is on the cell
 	return !c.isBomb()
 }
 func (c Cell) isAccessible() bool {
-	return (c & inaccessibleBits) == 0
+	return !c.isWall() && !c.isBox() && !c.isBomb()
 }
 func (c Cell) isWall() bool {
-	return (c & wallBit) > 0
+	return c.grid.walls.Has(c.idx)
 }
 func (c Cell) isBox() bool {
-	return (c & boxBits) > 0
+	return c.grid.boxes.Has(c.idx)
 }
 func (c Cell) isBomb() bool {
-	return (c & bombBits) > 0
+	return c.grid.bombs.Has(c.idx)
 }
 func (c Cell) isPlayer() bool {
-	return (c & playerBits) > 0
+	for i := 0; i < nbPlayers; i++ {
+		if c.grid.hasPlayer(i, c.idx) {
+			return true
+		}
+	}
+	return false
 }
 func (c Cell) isItem() bool {
-	return (c & itemBits) > 0
+	return !c.isBox() && c.getItemType() != itemNone
 }
 func (c Cell) getItemType() int {
-	if c&(item1Bit|boxWithItem1Bit) > 0 {
+	if c.grid.rangeItems.Has(c.idx) {
 		return itemExtraRange
-	} else if c&(item2Bit|boxWithItem2Bit) > 0 {
+	} else if c.grid.bombItems.Has(c.idx) {
 		return itemExtraBomb
 	}
 	return itemNone
 }
 func (c Cell) getPlayerIds() (playerIds []int) {
-	if (c & player0Bit) > 0 {
-		playerIds = append(playerIds, 0)
-	}
-	if (c & player1Bit) > 0 {
-		playerIds = append(playerIds, 1)
-	}
-	if (c & player2Bit) > 0 {
-		playerIds = append(playerIds, 2)
-	}
-	if (c & player3Bit) > 0 {
-		playerIds = append(playerIds, 3)
+	for i := 0; i < nbPlayers; i++ {
+		if c.grid.hasPlayer(i, c.idx) {
+			playerIds = append(playerIds, i)
+		}
 	}
-	//fmt.Fprintf(os.Stderr, "nbPlayers=%v\n", nbPlayers)
 	return
 }
 func (c Cell) getBombPlayerIds() (playerIds []int) {
-	if (c & bombPlayer0Bit) > 0 {
-		playerIds = append(playerIds, 0)
-	}
-	if (c & bombPlayer1Bit) > 0 {
-		playerIds = append(playerIds, 1)
+	if c.isBomb() {
+		playerIds = append(playerIds, c.grid.bombOwner(c.idx))
 	}
-	if (c & bombPlayer2Bit) > 0 {
-		playerIds = append(playerIds, 2)
-	}
-	if (c & bombPlayer3Bit) > 0 {
-		playerIds = append(playerIds, 3)
-	}
-	//fmt.Fprintf(os.Stderr, "nbPlayers=%v\n", len(playerIds))
 	return
 }
 
-type Line [nbCols]Cell
-type Grid [nbRows]Line
-
 func (g *Grid) acquire() {
 	for i := 0; i < nbRows; i++ {
 		var s string
-		fmt.Scan(&s)
-		for j := 0; j < nbCols; j++ {
-			switch s[j] {
-			case box:
-				g[i][j].SetBox(itemNone)
-			case boxWithExtraRange:
-				g[i][j].SetBox(itemExtraRange)
-			case boxWithExtraBomb:
-				g[i][j].SetBox(itemExtraBomb)
-			case wall:
-				g[i][j].SetWall()
+		fmt.Fscan(input, &s)
+		for j := 0; j < nbCols && j < len(s); j++ {
+			switch {
+			case s[j] >= box && s[j] <= '9':
+				// the items unknown to the bot are ignored, not the boxes hiding them
+				g.CellAt(Position{j, i}).SetBox(int(s[j] - box))
+			case s[j] == wall:
+				g.CellAt(Position{j, i}).SetWall()
 			}
 		}
 	}
 }
 
 func (cell Cell) String() string {
-	//fmt.Fprintf(os.Stderr, "raw: %o\n", int16(cell))
 	if cell.isEmpty() {
 		return " "
 	} else if cell.isWall() {
@@ -342,23 +485,19 @@ func (cell Cell) String() string {
 	return "?"
 }
 
-func (l Line) String() string {
-	var buffer bytes.Buffer
-	for _, cell := range l {
-		buffer.WriteString(fmt.Sprintf("%v", cell))
-	}
-	return buffer.String()
-}
 func (g Grid) String() string {
 	var buffer bytes.Buffer
-	for i := 0; i < nbRows; i++ {
-		buffer.WriteString(fmt.Sprintf("%v\n", g[i]))
+	for y := 0; y < nbRows; y++ {
+		for x := 0; x < nbCols; x++ {
+			buffer.WriteString(fmt.Sprintf("%v", g.CellAt(Position{x, y})))
+		}
+		buffer.WriteString("\n")
 	}
 	return buffer.String()
 }
 
-func (g *Grid) CellAt(p Position) *Cell {
-	return &(g[p.y][p.x])
+func (g *Grid) CellAt(p Position) Cell {
+	return Cell{g, p.index()}
 }
 
 type Action struct {
@@ -376,39 +515,59 @@ func (a Action) String() string {
 	return fmt.Sprintf("%v %v %v", actionString, a.pos.x, a.pos.y)
 }
 
+func ParseAction(line string) (a Action, ok bool) {
+	var command string
+	if _, err := fmt.Sscan(line, &command, &a.pos.x, &a.pos.y); err != nil {
+		return a, false
+	}
+	switch command {
+	case "MOVE":
+		a.action = move
+	case "BOMB":
+		a.action = dropBomb
+	default:
+		return a, false
+	}
+	return a, true
+}
+
 type GameArea struct {
 	grid            Grid
-	droppedBombs    []Bomb
+	droppedBombs    []Bomb // all the bombs on the grid, shared between states: never modify in place
 	players         [maxPlayers]Player
 	actionToGetHere Action
 	turn            int
 	previous        *GameArea
+	hash            uint64
+	stats           *SearchStats // counters of the worker searching this state
 }
 
 func (ga *GameArea) acquire() {
 	ga.grid.acquire()
 
 	var nbEntities int
-	fmt.Scan(&nbEntities)
+	fmt.Fscan(input, &nbEntities)
 
 	ga.droppedBombs = make([]Bomb, 0)
+	for pidx := range ga.players {
+		// only the players alive are listed
+		ga.players[pidx].isDead = true
+	}
 
 	for i := 0; i < nbEntities; i++ {
 		var entityType, owner, x, y, param1, param2 int
-		fmt.Scan(&entityType, &owner, &x, &y, &param1, &param2)
+		fmt.Fscan(input, &entityType, &owner, &x, &y, &param1, &param2)
 		pos := Position{x, y}
+		if !pos.IsOnGrid() || owner < 0 || owner >= nbPlayers {
+			continue
+		}
 		switch entityType {
 		case playerEntity:
-			ga.players[owner] = Player{pos, param1, param2, false, 0, 0, 0, 0, 0, 0}
+			ga.players[owner] = Player{Position: pos, remainingBombs: param1, bombRange: param2}
 			ga.grid.CellAt(pos).SetPlayer(owner)
 		case bombEntity:
 			ga.grid.CellAt(pos).SetBomb(owner)
-			if ga.previous != nil {
-				if !ga.previous.grid.CellAt(pos).isBomb() {
-					var bomb = Bomb{pos, owner}
-					ga.droppedBombs = append(ga.droppedBombs, bomb)
-				}
-			}
+			ga.droppedBombs = append(ga.droppedBombs, Bomb{pos, owner, param1, param2})
 		case itemEntity:
 			ga.grid.CellAt(pos).SetItem(param1)
 		}
@@ -419,6 +578,42 @@ func (ga *GameArea) NbBoxesInRangeOf(p Position, playerIdx int) int {
 	return len(ga.GetBoxesInRangeOf(p, playerIdx))
 }
 
+// Value of an item for the player, in thousandths of a box destroyed per
+// bomb: how much it raises his box destruction rate.
+// One more bomb adds a bomb to the ones he owns, one more range adds about a
+// box per bomb while the range is short.
+func (ga *GameArea) ItemValue(itemType int, playerIdx int) int {
+	p := ga.players[playerIdx]
+	switch itemType {
+	case itemExtraBomb:
+		owned := p.remainingBombs
+		for _, bomb := range ga.droppedBombs {
+			if bomb.ownerID == playerIdx {
+				owned++
+			}
+		}
+		if owned >= itemMaxUsefulBombs {
+			return 0
+		}
+		return 2000 / Max(owned, 1)
+	case itemExtraRange:
+		if p.bombRange >= itemMaxUsefulRange {
+			return 0
+		}
+		return 1000 * (itemMaxUsefulRange - p.bombRange) / (itemMaxUsefulRange - 2)
+	}
+	return 0
+}
+
+// Value of a bomb at p, in thousandths of a box: the boxes it destroys plus the
+// items it reveals
+func (ga *GameArea) BombValueAt(p Position, playerIdx int) (value int) {
+	for _, pos := range ga.GetBoxesInRangeOf(p, playerIdx) {
+		value += 1000 + ga.ItemValue(ga.grid.CellAt(pos).getItemType(), playerIdx)
+	}
+	return
+}
+
 func (ga *GameArea) GetBoxesInRangeOf(p Position, playerIdx int) (boxes []Position) {
 	boxes = make([]Position, 0)
 	for _, v := range cardinalVectors {
@@ -427,7 +622,7 @@ func (ga *GameArea) GetBoxesInRangeOf(p Position, playerIdx int) (boxes []Positi
 			pos = Add(pos, v)
 			if pos.IsOnGrid() {
 				cell := ga.grid.CellAt(pos)
-				if !cell.isEmpty() {
+				if cell.stopsBlasts() {
 					if cell.isBox() {
 						boxes = append(boxes, pos)
 					}
@@ -441,124 +636,128 @@ func (ga *GameArea) GetBoxesInRangeOf(p Position, playerIdx int) (boxes []Positi
 	return
 }
 
-func (ga *GameArea) Get8TurnsAgo() *GameArea {
-	loopGA := ga
-	for i := 0; i < bombTimer; i++ {
-		loopGA = loopGA.previous
-		if loopGA == nil {
-			//fmt.Fprintf(os.Stderr, "Only %v turns\n", i)
-			return nil
+// Removes the bombs on the given cells from the bombs waiting to explode and
+// returns them. Works in place: ga must own its droppedBombs.
+func (ga *GameArea) takeBombsIn(cells Bitboard) (bombs []Bomb) {
+	remaining := ga.droppedBombs[:0]
+	for _, bomb := range ga.droppedBombs {
+		if cells.Has(bomb.index()) {
+			bombs = append(bombs, bomb)
+		} else {
+			remaining = append(remaining, bomb)
 		}
 	}
-	return loopGA
+	ga.droppedBombs = remaining
+	return
 }
 
-func (ga *GameArea) ExplodeTimedOutBombs() (burnedCells map[Position]bool) {
-	ga8Ago := ga.Get8TurnsAgo()
-
-	if ga8Ago == nil {
-		return
-	}
+/* bombs of the same owner and range exploding together blast in parallel */
+type blast struct {
+	ownerID   int
+	bombRange int
+	origins   Bitboard
+}
 
-	var bombsToExplode []Bomb = make([]Bomb, 0)
+func (ga *GameArea) ExplodeTimedOutBombs() (burnedCells Bitboard) {
+	var bombsToExplode []Bomb
 
-	for _, bomb := range ga8Ago.droppedBombs {
-		//make sure it didn't explode prematurily
-		exploded := false
-		loopGA := ga
-		for i := 0; i < bombTimer; i++ {
-			if !loopGA.grid.CellAt(bomb.Position).isBomb() {
-				exploded = true
-				break
-			}
-			loopGA = loopGA.previous
-		}
-		if !exploded {
+	// count down on a copy: the previous state still references the old timers
+	countingDown := make([]Bomb, 0, len(ga.droppedBombs))
+	for _, bomb := range ga.droppedBombs {
+		bomb.timer--
+		if bomb.timer <= 0 {
 			bombsToExplode = append(bombsToExplode, bomb)
+		} else {
+			countingDown = append(countingDown, bomb)
 		}
 	}
+	ga.droppedBombs = countingDown
+
+	if len(bombsToExplode) == 0 {
+		return
+	}
 
 	//fmt.Fprintf(os.Stderr, "Bombs to explode: %v\n", bombsToExplode)
 
-	var cellsToBurn map[Position]bool = make(map[Position]bool)
-	burnedCells = make(map[Position]bool)
+	var cellsToBurn Bitboard
+	var hitBoxes [maxPlayers]Bitboard
+	obstacles := ga.grid.obstacles()
 	savedPlayers := ga.players
 
 	for len(bombsToExplode) > 0 {
-		countBombExploded++
-		if countBombExploded%100 == 0 {
-			elapsed := time.Since(begin)
-			//fmt.Fprintf(os.Stderr, "b-elapsed: %v\n", elapsed)
-			if elapsed > timeoutLimit*time.Millisecond {
-				timeout = true
-				fmt.Fprintf(os.Stderr, "b-elapsed: %v\n", elapsed)
-			}
-		}
-
-		bomb := bombsToExplode[0]
-		bombrange := ga8Ago.players[bomb.ownerID].bombRange
-
-		ga.grid.CellAt(bomb.Position).ResetBomb(bomb.ownerID)
-		ga.players[bomb.ownerID].remainingBombs++
-		bombsToExplode = bombsToExplode[1:]
-		cellsToBurn[bomb.Position] = true
-		burnedCells[bomb.Position] = true
-
-		for _, direction := range cardinalVectors {
-			pos := bomb.Position
-			for i := 1; i < bombrange; i++ {
-				pos = Add(pos, direction)
-				if !pos.IsOnGrid() {
-					break
-				}
-				burnedCells[pos] = true
-				if !ga.grid.CellAt(pos).isEmpty() {
-					cellsToBurn[pos] = true
-					if ga.grid.CellAt(pos).isBomb() {
-						for _, id := range ga.grid.CellAt(pos).getBombPlayerIds() {
-							bombsToExplode = append(bombsToExplode, Bomb{pos, id})
-						}
-					}
-					if ga.grid.CellAt(pos).isBox() {
-						ga.players[bomb.ownerID].score++
-					}
-					break
+		var blasts []blast
+		for _, bomb := range bombsToExplode {
+			stats := ga.Stats()
+			stats.nbBombsExploded++
+			if stats.nbBombsExploded%100 == 0 {
+				stats.CheckDeadline("b-elapsed")
+			}
+
+			ga.players[bomb.ownerID].remainingBombs++
+			cellsToBurn.Set(bomb.index())
+			burnedCells.Set(bomb.index())
+
+			b := 0
+			for b < len(blasts) && (blasts[b].ownerID != bomb.ownerID || blasts[b].bombRange != bomb.bombRange) {
+				b++
+			}
+			if b == len(blasts) {
+				blasts = append(blasts, blast{ownerID: bomb.ownerID, bombRange: bomb.bombRange})
+			}
+			blasts[b].origins.Set(bomb.index())
+		}
+
+		var hit Bitboard
+		for _, bl := range blasts {
+			for _, shift := range cardinalShifts {
+				ray := bl.origins
+				for i := 1; i < bl.bombRange && !ray.IsZero(); i++ {
+					ray = ray.Shift(shift)
+					burnedCells = burnedCells.Or(ray)
+					stopped := ray.And(obstacles)
+					hit = hit.Or(stopped)
+					hitBoxes[bl.ownerID] = hitBoxes[bl.ownerID].Or(stopped.And(ga.grid.boxes))
+					ray = ray.AndNot(stopped)
 				}
 			}
 		}
+		cellsToBurn = cellsToBurn.Or(hit)
+
+		// chain reaction
+		bombsToExplode = ga.takeBombsIn(hit.And(ga.grid.bombs))
 	}
 
 	for pidx := range ga.players {
+		ga.players[pidx].score += hitBoxes[pidx].Count()
 		if ga.players[pidx].score != savedPlayers[pidx].score {
-			ga.players[pidx].scorePerTurn += (ga.players[pidx].score - savedPlayers[pidx].score) * 1000 / (ga.turn - savedPlayers[pidx].lastScoreUpdate + 1)
+			ga.players[pidx].scorePerTurn += (ga.players[pidx].score - savedPlayers[pidx].score) * evalWeights.TimeScale / (ga.turn - savedPlayers[pidx].lastScoreUpdate + 1)
 			ga.players[pidx].lastScoreUpdate = ga.turn
 		}
 	}
 
-	for pos := range cellsToBurn {
-		ga.BurnCellAt(pos)
-	}
+	ga.burnCells(cellsToBurn)
 
-	//if len(burnedCells) > 0 {
+	//if !burnedCells.IsZero() {
 	//	fmt.Fprintf(os.Stderr, "BurnedCells=%v\n", burnedCells)
 	//}
 
 	return
 }
 
-func (ga *GameArea) BurnCellAt(pos Position) {
-	for id := range ga.grid.CellAt(pos).getPlayerIds() {
-		ga.players[id].isDead = true
-	}
-
-	itemDropped := itemNone
-	if ga.grid.CellAt(pos).isBox() {
-		itemDropped = ga.grid.CellAt(pos).getItemType()
+// kills the players on the cells and burns the cells, boxes drop their item
+func (ga *GameArea) burnCells(cells Bitboard) {
+	for id := range ga.players {
+		if ga.grid.playerIn(id, cells) {
+			ga.players[id].isDead = true
+		}
 	}
+	ga.grid.burn(cells)
+}
 
-	ga.grid.CellAt(pos).Burn()
-
-	ga.grid.CellAt(pos).SetItem(itemDropped)
+func (ga *GameArea) BurnCellAt(pos Position) {
+	var cells Bitboard
+	cells.Set(pos.index())
+	ga.burnCells(cells)
 }
 
 func (ga *GameArea) GetNextStates(playerId int) (nextStates []*GameArea) {
@@ -576,8 +775,24 @@ func (ga *GameArea) GetNextStates(playerId int) (nextStates []*GameArea) {
 	nextStateBase.ExplodeTimedOutBombs()
 
 	nextnext := nextStateBase
-	nextnext.previous = &nextStateBase
 	forbiddenCells := nextnext.ExplodeTimedOutBombs()
+	allowedCells := nextStateBase.grid.accessible().AndNot(forbiddenCells)
+
+	// prune the moves leading to a certain death and spot the kill traps:
+	// one map without our new bomb, one with it
+	var dangerMaps [2]*DangerMap
+	if (pruneWithDangerMap || attackMode) && nextStateBase.turn-turn <= pruneHorizon {
+		dangerMaps[0] = nextStateBase.DangerMap()
+		if nbLoops == 2 {
+			withBomb := nextStateBase
+			withBomb.DropBomb(playerId)
+			dangerMaps[1] = withBomb.DangerMap()
+		}
+	}
+	trapped := 0
+	if attackMode && dangerMaps[1] != nil {
+		trapped = nextStateBase.NbOpponentsTrapped(playerId, dangerMaps[0], dangerMaps[1])
+	}
 
 	for i := 0; i < nbLoops; i++ {
 		for dir := 0; dir < nbCardinalDirections+1; dir++ {
@@ -587,40 +802,213 @@ func (ga *GameArea) GetNextStates(playerId int) (nextStates []*GameArea) {
 			} else {
 				// stay there
 			}
-			if pos.IsOnGrid() && nextStateBase.grid.CellAt(pos).isAccessible() && !forbiddenCells[pos] {
+			if pos.IsOnGrid() && allowedCells.Has(pos.index()) &&
+				(!pruneWithDangerMap || dangerMaps[i] == nil || dangerMaps[i].CanEscapeFrom(pos)) {
 				nextState := new(GameArea)
 				*nextState = nextStateBase
 
+				// the base still holds the action of the parent
+				nextState.actionToGetHere.action = move
 				if i > 0 {
 					nextState.DropBomb(playerId)
 					nextState.actionToGetHere.action = dropBomb
-					nextState.players[playerId].potential += nextState.NbBoxesInRangeOf(pos, playerId)
-					nextState.players[playerId].potPerTurn += nextState.NbBoxesInRangeOf(pos, playerId) * 1000 / (nextState.turn - nextState.players[playerId].lastPotUpdate + 1)
+					nextState.players[playerId].trapsSet += trapped
+					nextState.players[playerId].potential += nextState.NbBoxesInRangeOf(oPos, playerId)
+					nextState.players[playerId].potPerTurn += nextState.BombValueAt(oPos, playerId) * evalWeights.TimeScale / 1000 / (nextState.turn - nextState.players[playerId].lastPotUpdate + 1)
+				}
+				if cell := nextState.grid.CellAt(pos); cell.isItem() {
+					nextState.players[playerId].potPerTurn += nextState.ItemValue(cell.getItemType(), playerId) * evalWeights.TimeScale / 1000 / (nextState.turn - nextState.players[playerId].lastPotUpdate + 1)
 				}
 				nextState.MovePlayer(playerId, pos)
 				nextState.actionToGetHere.pos = pos
 
+				if opponentAware && !nextState.players[playerId].inDanger &&
+					nextState.turn-turn <= threatHorizon && nextState.IsThreatenedByOpponents(playerId) {
+					nextState.players[playerId].inDanger = true
+				}
+
 				nextStates = append(nextStates, nextState)
 
-				countGeneratedStates++
-				if countGeneratedStates%100 == 0 {
-					elapsed := time.Since(begin)
-					//fmt.Fprintf(os.Stderr, "g-elapsed: %v\n", elapsed)
-					if elapsed > timeoutLimit*time.Millisecond {
-						timeout = true
-						fmt.Fprintf(os.Stderr, "g-elapsed: %v\n", elapsed)
+				stats := nextState.Stats()
+				stats.nbGeneratedStates++
+				if stats.nbGeneratedStates%100 == 0 {
+					stats.CheckDeadline("g-elapsed")
+				}
+			}
+		}
+	}
+
+	return
+}
+
+// Simulates the next nbTurns turns without any move.
+// burned[t] holds the cells burned by the explosions of turn t+1,
+// grids[t] the grid just after them.
+func (ga *GameArea) BurnTimeline(nbTurns int) (grids []Grid, burned []Bitboard) {
+	state := *ga
+	grids = make([]Grid, nbTurns)
+	burned = make([]Bitboard, nbTurns)
+	for t := 0; t < nbTurns; t++ {
+		state.turn++
+		burned[t] = state.ExplodeTimedOutBombs()
+		grids[t] = state.grid
+	}
+	return
+}
+
+/* Safety analysis of the bombs already on the grid, players standing still */
+type DangerMap struct {
+	grid        Grid
+	burnTurn    [bbWords * 64]int8 // number of turns before the cell first burns, 0 if never
+	escapeTurns [bbWords * 64]int8 // turns needed to reach a cell that never burns again, -1 if impossible
+}
+
+func (ga *GameArea) DangerMap() (dm *DangerMap) {
+	dm = &DangerMap{grid: ga.grid}
+	grids, burned := ga.BurnTimeline(bombTimer)
+
+	for t := bombTimer - 1; t >= 0; t-- {
+		for _, pos := range burned[t].Positions() {
+			dm.burnTurn[pos.index()] = int8(t + 1)
+		}
+	}
+
+	// backward induction: escape[p] at turn t from the ones at turn t+1
+	var next, current [bbWords * 64]int8 // all safe once every bomb exploded
+	var burnsLater Bitboard
+	for t := bombTimer - 1; t >= 0; t-- {
+		accessible := grids[t].accessible()
+		for y := 0; y < nbRows; y++ {
+			for x := 0; x < nbCols; x++ {
+				idx := Position{x, y}.index()
+				if burned[t].Has(idx) {
+					current[idx] = -1
+				} else if !burnsLater.Has(idx) {
+					current[idx] = 0
+				} else {
+					best := next[idx] // stay there, even on a bomb
+					for d, v := range cardinalVectors {
+						n := Add(Position{x, y}, v)
+						if n.IsOnGrid() && accessible.Has(idx+cardinalShifts[d]) && next[n.index()] >= 0 && (best < 0 || next[n.index()] < best) {
+							best = next[n.index()]
+						}
 					}
+					if best >= 0 {
+						best++
+					}
+					current[idx] = best
+				}
+			}
+		}
+		burnsLater = burnsLater.Or(burned[t])
+		next = current
+	}
+	dm.escapeTurns = next
+	return
+}
+
+func (dm *DangerMap) BurnTurn(pos Position) int {
+	return int(dm.burnTurn[pos.index()])
+}
+
+func (dm *DangerMap) EscapeTurns(pos Position) int {
+	return int(dm.escapeTurns[pos.index()])
+}
+
+func (dm *DangerMap) CanEscapeFrom(pos Position) bool {
+	return dm.escapeTurns[pos.index()] >= 0
+}
+
+// Heatmaps of the turn each cell burns and of the turns needed to escape from
+// it: '.' never burns or already safe, '!' no escape, '+' wall, '#' box
+func (dm DangerMap) String() string {
+	var buffer bytes.Buffer
+	buffer.WriteString("burn turn      escape turns\n")
+	for y := 0; y < nbRows; y++ {
+		for map_ := 0; map_ < 2; map_++ {
+			for x := 0; x < nbCols; x++ {
+				pos := Position{x, y}
+				cell := dm.grid.CellAt(pos)
+				switch {
+				case cell.isWall():
+					buffer.WriteByte('+')
+				case cell.isBox():
+					buffer.WriteByte('#')
+				case map_ == 0 && dm.BurnTurn(pos) == 0, map_ == 1 && dm.EscapeTurns(pos) == 0:
+					buffer.WriteByte('.')
+				case map_ == 1 && dm.EscapeTurns(pos) < 0:
+					buffer.WriteByte('!')
+				case map_ == 0:
+					buffer.WriteByte(byte('0' + dm.BurnTurn(pos)))
+				default:
+					buffer.WriteByte(byte('0' + Min(dm.EscapeTurns(pos), 9)))
 				}
 			}
+			buffer.WriteString("  ")
 		}
+		buffer.WriteString("\n")
 	}
+	return buffer.String()
+}
+
+// Tells if the player can reach, without dropping any bomb, a cell where he
+// survives all the bombs already on the grid.
+func (ga *GameArea) CanEscape(playerId int) bool {
+	return ga.DangerMap().CanEscapeFrom(ga.players[playerId].Position)
+}
 
+// Number of opponents who could escape before our bomb and can't any more
+func (ga *GameArea) NbOpponentsTrapped(playerId int, before, after *DangerMap) (trapped int) {
+	for pidx, p := range ga.players {
+		if pidx != playerId && !p.isDead && before.CanEscapeFrom(p.Position) && !after.CanEscapeFrom(p.Position) {
+			trapped++
+		}
+	}
 	return
 }
 
+// Worst case enemy bomb drops: every opponent able to bomb drops one where he
+// stands, each alone then all together.
+// The player is threatened if one of these drops leaves him no escape.
+func (ga *GameArea) IsThreatenedByOpponents(playerId int) bool {
+	target := ga.players[playerId]
+	var bombers []int
+	for pidx, p := range ga.players {
+		if pidx == playerId || p.isDead || p.remainingBombs <= 0 || !ga.grid.CellAt(p.Position).CanReceiveBombNow() {
+			continue
+		}
+		if abs(p.x-target.x)+abs(p.y-target.y) > bombTimer {
+			continue
+		}
+		bombers = append(bombers, pidx)
+	}
+
+	scenarios := make([][]int, 0, len(bombers)+1)
+	for _, pidx := range bombers {
+		scenarios = append(scenarios, []int{pidx})
+	}
+	if len(bombers) > 1 {
+		scenarios = append(scenarios, bombers)
+	}
+
+	for _, scenario := range scenarios {
+		threatened := *ga
+		for _, pidx := range scenario {
+			threatened.DropBomb(pidx)
+		}
+		if !threatened.CanEscape(playerId) {
+			return true
+		}
+	}
+	return false
+}
+
 func (ga *GameArea) DropBomb(playerId int) {
 	pos := ga.players[playerId].Position
-	ga.droppedBombs = append(ga.droppedBombs, Bomb{pos, playerId})
+	ga.players[playerId].remainingBombs--
+	// the full slice expression forces a copy: the siblings share the backing array
+	nbBombs := len(ga.droppedBombs)
+	ga.droppedBombs = append(ga.droppedBombs[:nbBombs:nbBombs], Bomb{pos, playerId, bombTimer, ga.players[playerId].bombRange})
 	ga.grid.CellAt(pos).SetBomb(playerId)
 }
 
@@ -635,6 +1023,8 @@ func (ga *GameArea) MovePlayer(playerId int, target Position) {
 		case itemExtraRange:
 			ga.players[playerId].bombRange++
 		}
+		ga.players[playerId].itemsPicked++
+		ga.grid.CellAt(target).ResetItem()
 	}
 }
 
@@ -647,55 +1037,369 @@ func (ga GameArea) String() string {
 	return buffer.String()
 }
 
-func Diff(g1, g2 *GameArea) {
-	for y, line := range g1.grid {
-		for x, cell := range line {
-			pos := Position{x, y}
-			cell2 := *g2.grid.CellAt(pos)
-			if cell != cell2 && !cell.isPlayer() && !cell2.isPlayer() {
-				fmt.Fprintf(os.Stderr, "diff at %v: %v != %v\n", pos, cell, cell2)
-			}
+/* Consistency checker: the acquired state against the one simulated from
+ * the previous turn, with the actions the players were seen doing */
+var consistencyStats map[string]int = make(map[string]int)
+var nbTurnsChecked int
+
+// Simulates the turn leading to acquired: explosions, then the bombs that
+// appeared under the players, then the moves to their acquired positions.
+func (ga *GameArea) PredictNext(acquired *GameArea) (predicted GameArea) {
+	predicted = *ga
+	predicted.turn++
+	predicted.ExplodeTimedOutBombs()
+	for _, bomb := range acquired.droppedBombs {
+		if bomb.timer == bombTimer && !predicted.players[bomb.ownerID].isDead && predicted.players[bomb.ownerID].Position == bomb.Position {
+			predicted.DropBomb(bomb.ownerID)
 		}
 	}
+	for pidx, p := range acquired.players {
+		if !p.isDead && !predicted.players[pidx].isDead && predicted.players[pidx].Position != p.Position {
+			predicted.MovePlayer(pidx, p.Position)
+		}
+	}
+	return
 }
 
-func (ga *GameArea) NbTurnsSinceReference() int {
-	return ga.turn - turn
-}
+// Compares every field the input gives, the scores are not part of it.
+// Returns the mismatches found, by category.
+func CheckConsistency(previous, acquired *GameArea, myAction Action) (mismatches map[string][]string) {
+	mismatches = make(map[string][]string)
+	add := func(category string, format string, args ...interface{}) {
+		mismatches[category] = append(mismatches[category], fmt.Sprintf(format, args...))
+	}
+	predicted := previous.PredictNext(acquired)
+
+	boards := []struct {
+		category            string
+		predicted, acquired Bitboard
+	}{
+		{"walls", predicted.grid.walls, acquired.grid.walls},
+		{"boxes", predicted.grid.boxes, acquired.grid.boxes},
+		{"range items", predicted.grid.rangeItems, acquired.grid.rangeItems},
+		{"bomb items", predicted.grid.bombItems, acquired.grid.bombItems},
+		{"bombs", predicted.grid.bombs, acquired.grid.bombs},
+	}
+	for _, board := range boards {
+		if board.predicted != board.acquired {
+			add(board.category, "missing %v unexpected %v", board.acquired.AndNot(board.predicted), board.predicted.AndNot(board.acquired))
+		}
+	}
 
-func (ga *GameArea) HasToBeTreatedBefore(ga2 *GameArea) bool {
-	s1, s2 := ga.players[me].scorePerTurn, ga2.players[me].scorePerTurn
-	if s1 != s2 {
-		return s1 > s2
+	for pidx := range acquired.players {
+		p1, p2 := predicted.players[pidx], acquired.players[pidx]
+		switch {
+		case p1.isDead != p2.isDead:
+			add("player dead", "player %v dead=%v expected %v", pidx, p2.isDead, p1.isDead)
+		case p1.isDead:
+		case p1.Position != p2.Position:
+			add("player position", "player %v at %v expected %v", pidx, p2.Position, p1.Position)
+		case p1.remainingBombs != p2.remainingBombs:
+			add("player bombs", "player %v has %v bombs expected %v", pidx, p2.remainingBombs, p1.remainingBombs)
+		case p1.bombRange != p2.bombRange:
+			add("player range", "player %v has range %v expected %v", pidx, p2.bombRange, p1.bombRange)
+		}
 	}
-	p1, p2 := ga.players[me].potPerTurn, ga2.players[me].potPerTurn
-	if p1 != p2 {
-		return p1 > p2
+	if !acquired.players[me].isDead && acquired.players[me].Position != myAction.pos {
+		add("my move", "at %v after %v", acquired.players[me].Position, myAction)
 	}
-	return ga.turn < ga2.turn
-}
 
-var nbCritDead, nbCritSpt, nbCritPpt, nbCritTurn int
+	for _, bomb := range acquired.droppedBombs {
+		for _, simulated := range predicted.droppedBombs {
+			if simulated.Position == bomb.Position && simulated != bomb {
+				add("bomb state", "%v expected %v (range %v/%v)", bomb, simulated, bomb.bombRange, simulated.bombRange)
+			}
+		}
+	}
+	return
+}
 
-func (ga *GameArea) IsBetterThan(ga2 *GameArea) bool {
-	if ga.players[me].isDead != ga2.players[me].isDead {
-		nbCritDead++
-		return !ga.players[me].isDead
+// Checks the acquired state, prints the mismatches and the statistics, and
+// writes the two turns as a replayable input when a fixture directory is given.
+func CheckTurn(previous, acquired *GameArea, myAction Action) {
+	mismatches := CheckConsistency(previous, acquired, myAction)
+	nbTurnsChecked++
+	if len(mismatches) == 0 {
+		consistencyStats["ok"]++
 	}
-	s1, s2 := ga.players[me].scorePerTurn, ga2.players[me].scorePerTurn
-	if s1 != s2 {
-		nbCritSpt++
-		return s1 > s2
+	for category, details := range mismatches {
+		consistencyStats[category]++
+		for _, detail := range details {
+			fmt.Fprintf(os.Stderr, "mismatch %v: %v\n", category, detail)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "consistency over %v turns: %v\n", nbTurnsChecked, consistencyStats)
+
+	if fixturesDir != "" && len(mismatches) > 0 {
+		path := filepath.Join(fixturesDir, fmt.Sprintf("hypersonic-turn%03d.txt", acquired.turn))
+		var buffer bytes.Buffer
+		fmt.Fprintf(&buffer, "%v %v %v\n", nbCols, nbRows, me)
+		previous.WriteInput(&buffer)
+		acquired.WriteInput(&buffer)
+		if err := os.WriteFile(path, buffer.Bytes(), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot write the fixture: %v\n", err)
+		}
+	}
+}
+
+// Tells if ga2 is the state ga was simulated to be: same cells, and for every
+// player the same position, bombs, range and score. The states searched from
+// ga see the opponents where ga has them.
+func (ga *GameArea) Matches(ga2 *GameArea) bool {
+	g1, g2 := &ga.grid, &ga2.grid
+	if g1.walls != g2.walls || g1.boxes != g2.boxes || g1.rangeItems != g2.rangeItems || g1.bombItems != g2.bombItems || g1.bombs != g2.bombs || g1.bombOwners != g2.bombOwners {
+		return false
+	}
+	for pidx := range ga.players {
+		p1, p2 := ga.players[pidx], ga2.players[pidx]
+		if p1.isDead != p2.isDead {
+			return false
+		}
+		if !p1.isDead && (p1.Position != p2.Position || p1.remainingBombs != p2.remainingBombs || p1.bombRange != p2.bombRange || p1.score != p2.score) {
+			return false
+		}
+	}
+	return true
+}
+
+/* Zobrist hashing: random keys xored together for every feature of a state */
+const (
+	zobristMaxCount = 16  // bombs and ranges above share the last key
+	zobristTurns    = 512 // more than the turns of a game and its search
+)
+
+type ZobristKeys struct {
+	boxes, rangeItems, bombItems [bbWords * 64]uint64
+	bombs                        [maxPlayers][bombTimer + 1][bbWords * 64]uint64
+	droppedRange                 [zobristMaxCount][bbWords * 64]uint64
+	players                      [maxPlayers][bbWords * 64]uint64
+	remainingBombs, bombRange    [maxPlayers][zobristMaxCount]uint64
+	dead                         [maxPlayers]uint64
+	turns                        [zobristTurns]uint64
+}
+
+var zobrist *ZobristKeys = func() *ZobristKeys {
+	z := new(ZobristKeys)
+	rnd := rand.New(rand.NewSource(42))
+	for i := range z.boxes {
+		z.boxes[i], z.rangeItems[i], z.bombItems[i] = rnd.Uint64(), rnd.Uint64(), rnd.Uint64()
+		for pidx := 0; pidx < maxPlayers; pidx++ {
+			z.players[pidx][i] = rnd.Uint64()
+			for t := range z.bombs[pidx] {
+				z.bombs[pidx][t][i] = rnd.Uint64()
+			}
+		}
+		for n := range z.droppedRange {
+			z.droppedRange[n][i] = rnd.Uint64()
+		}
+	}
+	for t := range z.turns {
+		z.turns[t] = rnd.Uint64()
+	}
+	for pidx := 0; pidx < maxPlayers; pidx++ {
+		for n := 0; n < zobristMaxCount; n++ {
+			z.remainingBombs[pidx][n], z.bombRange[pidx][n] = rnd.Uint64(), rnd.Uint64()
+		}
+		z.dead[pidx] = rnd.Uint64()
+	}
+	return z
+}()
+
+func (b Bitboard) hash(keys *[bbWords * 64]uint64) (h uint64) {
+	for w, word := range b {
+		for word != 0 {
+			h ^= keys[w*64+bits.TrailingZeros64(word)]
+			word &= word - 1
+		}
+	}
+	return
+}
+
+// Walls never change: they are left out.
+// The turn is in: the same cells reached at two depths are two states.
+func (ga *GameArea) Hash() (h uint64) {
+	h = ga.grid.boxes.hash(&zobrist.boxes) ^ ga.grid.rangeItems.hash(&zobrist.rangeItems) ^ ga.grid.bombItems.hash(&zobrist.bombItems)
+	h ^= zobrist.turns[ga.turn%zobristTurns]
+	for _, bomb := range ga.droppedBombs {
+		h ^= zobrist.bombs[bomb.ownerID][Min(bomb.timer, bombTimer)][bomb.index()]
+		h ^= zobrist.droppedRange[Min(Max(bomb.bombRange, 0), zobristMaxCount-1)][bomb.index()]
+	}
+	for pidx, p := range ga.players {
+		if p.isDead {
+			h ^= zobrist.dead[pidx]
+			continue
+		}
+		h ^= zobrist.players[pidx][p.index()]
+		h ^= zobrist.remainingBombs[pidx][Min(Max(p.remainingBombs, 0), zobristMaxCount-1)]
+		h ^= zobrist.bombRange[pidx][Min(Max(p.bombRange, 0), zobristMaxCount-1)]
+	}
+	return
+}
+
+func (ga *GameArea) NbTurnsSinceReference() int {
+	return ga.turn - turn
+}
+
+/* Evaluation of the states.
+ * The default compares lexicographically: isDead, inDanger, trapsSet,
+ * scorePerTurn, potPerTurn, turn. With lexicographic false, the weighted sum
+ * of Evaluation replaces trapsSet, scorePerTurn and potPerTurn. */
+type EvalWeights struct {
+	Lexicographic    bool    `json:"lexicographic"`
+	TimeScale        int     `json:"timeScale"` // numerator of scorePerTurn and potPerTurn
+	BoxesDestroyed   float64 `json:"boxesDestroyed"`
+	Potential        float64 `json:"potential"`
+	ItemsPickedUp    float64 `json:"itemsPickedUp"`
+	OpponentDistance float64 `json:"opponentDistance"`
+	BombsRemaining   float64 `json:"bombsRemaining"`
+	TrapsSet         float64 `json:"trapsSet"`
+}
+
+var evalWeights EvalWeights = EvalWeights{Lexicographic: true, TimeScale: 1000, BoxesDestroyed: 1, Potential: 1, TrapsSet: 10000}
+
+// Reads the weights from the JSON file, or from the JSON in the HYPERSONIC_WEIGHTS
+// environment variable. Missing keys keep their default value.
+func LoadEvalWeights(path string) error {
+	var content []byte
+	if path != "" {
+		var err error
+		if content, err = os.ReadFile(path); err != nil {
+			return err
+		}
+	} else if env := os.Getenv("HYPERSONIC_WEIGHTS"); env != "" {
+		content = []byte(env)
+	} else {
+		return nil
+	}
+	return json.Unmarshal(content, &evalWeights)
+}
+
+func (ga *GameArea) DistanceToOpponents(playerId int) int {
+	distance := 0
+	for pidx, p := range ga.players {
+		if pidx == playerId || p.isDead {
+			continue
+		}
+		d := abs(p.x-ga.players[playerId].x) + abs(p.y-ga.players[playerId].y)
+		if distance == 0 || d < distance {
+			distance = d
+		}
+	}
+	return distance
+}
+
+func (ga *GameArea) Evaluation() float64 {
+	p := ga.players[me]
+	return evalWeights.BoxesDestroyed*float64(p.scorePerTurn) +
+		evalWeights.Potential*float64(p.potPerTurn) +
+		evalWeights.ItemsPickedUp*float64(p.itemsPicked) +
+		evalWeights.OpponentDistance*float64(ga.DistanceToOpponents(me)) +
+		evalWeights.BombsRemaining*float64(p.remainingBombs) +
+		evalWeights.TrapsSet*float64(p.trapsSet)
+}
+
+func (ga *GameArea) HasToBeTreatedBefore(ga2 *GameArea) bool {
+	if ga.players[me].inDanger != ga2.players[me].inDanger {
+		return !ga.players[me].inDanger
+	}
+	if !evalWeights.Lexicographic {
+		if e1, e2 := ga.Evaluation(), ga2.Evaluation(); e1 != e2 {
+			return e1 > e2
+		}
+		return ga.turn < ga2.turn
+	}
+	if t1, t2 := ga.players[me].trapsSet, ga2.players[me].trapsSet; t1 != t2 {
+		return t1 > t2
+	}
+	s1, s2 := ga.players[me].scorePerTurn, ga2.players[me].scorePerTurn
+	if s1 != s2 {
+		return s1 > s2
 	}
 	p1, p2 := ga.players[me].potPerTurn, ga2.players[me].potPerTurn
 	if p1 != p2 {
-		nbCritPpt++
 		return p1 > p2
 	}
-	nbCritTurn++
+	return ga.turn < ga2.turn
+}
+
+func (ga *GameArea) IsBetterThan(ga2 *GameArea) bool {
+	stats := ga.Stats()
+	if ga.players[me].isDead != ga2.players[me].isDead {
+		stats.nbCritDead++
+		return !ga.players[me].isDead
+	}
+	if ga.players[me].inDanger != ga2.players[me].inDanger {
+		stats.nbCritDanger++
+		return !ga.players[me].inDanger
+	}
+	if !evalWeights.Lexicographic {
+		if e1, e2 := ga.Evaluation(), ga2.Evaluation(); e1 != e2 {
+			stats.nbCritEval++
+			return e1 > e2
+		}
+		stats.nbCritTurn++
+		return ga.turn > ga2.turn
+	}
+	if t1, t2 := ga.players[me].trapsSet, ga2.players[me].trapsSet; t1 != t2 {
+		stats.nbCritTraps++
+		return t1 > t2
+	}
+	s1, s2 := ga.players[me].scorePerTurn, ga2.players[me].scorePerTurn
+	if s1 != s2 {
+		stats.nbCritSpt++
+		return s1 > s2
+	}
+	p1, p2 := ga.players[me].potPerTurn, ga2.players[me].potPerTurn
+	if p1 != p2 {
+		stats.nbCritPpt++
+		return p1 > p2
+	}
+	stats.nbCritTurn++
 	return ga.turn > ga2.turn
 }
 
+/* counters of one search worker, shared by all the states it generates */
+type SearchStats struct {
+	ctx                                                                                 context.Context // deadline of the turn
+	timeout                                                                             bool
+	nbBombsExploded, nbGeneratedStates                                                  int
+	nbCritDead, nbCritDanger, nbCritEval, nbCritTraps, nbCritSpt, nbCritPpt, nbCritTurn int
+}
+
+// used by the states out of any search: referee, consistency checks
+var untrackedStats SearchStats
+
+func (ga *GameArea) Stats() *SearchStats {
+	if ga.stats == nil {
+		return &untrackedStats
+	}
+	return ga.stats
+}
+
+func (s *SearchStats) CheckDeadline(label string) {
+	if !s.timeout && s.ctx != nil && s.ctx.Err() != nil {
+		s.timeout = true
+		fmt.Fprintf(os.Stderr, "%v: %v\n", label, time.Since(begin))
+	}
+}
+
+func (s *SearchStats) Add(s2 *SearchStats) {
+	s.timeout = s.timeout || s2.timeout
+	s.nbBombsExploded += s2.nbBombsExploded
+	s.nbGeneratedStates += s2.nbGeneratedStates
+	s.nbCritDead += s2.nbCritDead
+	s.nbCritDanger += s2.nbCritDanger
+	s.nbCritEval += s2.nbCritEval
+	s.nbCritTraps += s2.nbCritTraps
+	s.nbCritSpt += s2.nbCritSpt
+	s.nbCritPpt += s2.nbCritPpt
+	s.nbCritTurn += s2.nbCritTurn
+}
+
+func (s SearchStats) String() string {
+	return fmt.Sprintf("crit d=%v dgr=%v eval=%v trap=%v spt=%v ppt=%v t=%v", s.nbCritDead, s.nbCritDanger, s.nbCritEval, s.nbCritTraps, s.nbCritSpt, s.nbCritPpt, s.nbCritTurn)
+}
+
 type genHeap []*GameArea
 
 func (h genHeap) Len() int            { return len(h) }
@@ -710,16 +1414,323 @@ func (h *genHeap) Pop() interface{} {
 	return x
 }
 
+/* search tree kept from one turn to the next by the beam planner */
+type SearchNode struct {
+	ga       *GameArea
+	parent   *SearchNode
+	children []*SearchNode
+	expanded bool
+}
+
+func (n *SearchNode) Children(stats *SearchStats) []*SearchNode {
+	if !n.expanded {
+		n.ga.stats = stats // the node may come from the tree of a previous turn
+		for _, state := range n.ga.GetNextStates(me) {
+			if !state.players[me].isDead {
+				n.children = append(n.children, &SearchNode{ga: state, parent: n})
+			}
+		}
+		n.expanded = true
+	}
+	return n.children
+}
+
+// Returns the child of the root leading to n
+func (n *SearchNode) FirstStep() *SearchNode {
+	for n.parent != nil && n.parent.parent != nil {
+		n = n.parent
+	}
+	return n
+}
+
+// Keeps the beamWidth most promising nodes of each depth until timeout.
+// Nodes expanded during the previous turns are not generated again.
+func BeamSearch(root *SearchNode, stats *SearchStats, turnStats map[int]int) (best *SearchNode, nbExpanded int) {
+	frontier := []*SearchNode{root}
+	for len(frontier) > 0 && !stats.timeout {
+		var next []*SearchNode
+		for _, node := range frontier {
+			if !node.expanded {
+				nbExpanded++
+			} else {
+				// no state generated: the deadline is checked here
+				stats.CheckDeadline("walk-elapsed")
+				if stats.timeout {
+					break
+				}
+			}
+			for _, child := range node.Children(stats) {
+				next = append(next, child)
+				if best == nil || child.ga.IsBetterThan(best.ga) {
+					best = child
+				}
+				turnStats[child.ga.turn]++
+			}
+			if stats.timeout {
+				break
+			}
+		}
+		sort.Slice(next, func(i, j int) bool { return next[i].ga.HasToBeTreatedBefore(next[j].ga) })
+		if len(next) > beamWidth {
+			// the subtrees of the previous turns out of the beam are let go
+			for _, node := range next[beamWidth:] {
+				node.children, node.expanded = nil, false
+			}
+			next = next[:beamWidth]
+		}
+		frontier = next
+	}
+	return
+}
+
+/* best-first search of a part of the tree, run by one goroutine */
+type SearchWorker struct {
+	stats                                    SearchStats
+	queue                                    genHeap
+	transpositions                           map[uint64]*GameArea
+	best                                     *GameArea
+	turnStats                                map[int]int
+	nbTreated, nbRemaining, nbTranspositions int
+}
+
+func NewSearchWorker(ctx context.Context) *SearchWorker {
+	return &SearchWorker{
+		stats:          SearchStats{ctx: ctx},
+		queue:          make(genHeap, 0, 1000),
+		transpositions: make(map[uint64]*GameArea),
+		turnStats:      make(map[int]int)}
+}
+
+// Queues a generated state, unless a better one with the same hash is known
+func (w *SearchWorker) Add(state *GameArea) {
+	if state.players[me].isDead {
+		return
+	}
+	if useTranspositions {
+		state.hash = state.Hash()
+		if known, found := w.transpositions[state.hash]; found {
+			w.nbTranspositions++
+			if !state.IsBetterThan(known) {
+				return
+			}
+		}
+		w.transpositions[state.hash] = state
+	}
+	heap.Push(&w.queue, state)
+	if w.best == nil || state.IsBetterThan(w.best) {
+		w.best = state
+	}
+	w.turnStats[state.turn]++
+}
+
+// Expands the queued states until the queue is empty or the deadline is reached.
+// The root, if any, is queued without being a candidate for the best state.
+func (w *SearchWorker) Run(root *GameArea) {
+	if root != nil {
+		root.stats = &w.stats
+		heap.Push(&w.queue, root)
+	}
+	for len(w.queue) > 0 && !w.stats.timeout {
+		var currentGA *GameArea = heap.Pop(&w.queue).(*GameArea)
+		if useTranspositions && currentGA != root && w.transpositions[currentGA.hash] != currentGA {
+			// a better state with the same hash was found since this one was queued
+			continue
+		}
+		for _, state := range currentGA.GetNextStates(me) {
+			w.Add(state)
+		}
+		w.nbTreated++
+		if w.nbTreated%100 == 0 {
+			w.stats.CheckDeadline("elapsed")
+		}
+	}
+	w.nbRemaining = len(w.queue)
+}
+
+func (w *SearchWorker) Merge(w2 *SearchWorker) {
+	w.stats.Add(&w2.stats)
+	if w2.best != nil && (w.best == nil || w2.best.IsBetterThan(w.best)) {
+		w.best = w2.best
+	}
+	for t, n := range w2.turnStats {
+		w.turnStats[t] += n
+	}
+	w.nbTreated += w2.nbTreated
+	w.nbRemaining += w2.nbRemaining
+	w.nbTranspositions += w2.nbTranspositions
+}
+
+// Best-first search from root. With several workers, the children of the root
+// are dealt among them and each one searches its subtrees with its own queue.
+func ParallelSearch(ctx context.Context, root *GameArea, nbWorkers int) *SearchWorker {
+	workers := make([]*SearchWorker, nbWorkers)
+	for i := range workers {
+		workers[i] = NewSearchWorker(ctx)
+	}
+	if nbWorkers <= 1 {
+		workers[0].Run(root)
+		return workers[0]
+	}
+
+	root.stats = &workers[0].stats
+	children := root.GetNextStates(me)
+	workers[0].nbTreated++
+	for i, child := range children {
+		w := workers[i%nbWorkers]
+		child.stats = &w.stats
+		w.Add(child)
+	}
+
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w *SearchWorker) {
+			defer wg.Done()
+			w.Run(nil)
+		}(w)
+	}
+	wg.Wait()
+
+	merged := NewSearchWorker(ctx)
+	for _, w := range workers {
+		merged.Merge(w)
+	}
+	return merged
+}
+
 var me int //index of me
-var timeout bool
 var begin time.Time
 var turn int
 var currentGameArea *GameArea
-var countBombExploded, countGeneratedStates int
+var nbWorkers int
+var opponentAware bool
+var useTranspositions bool
+var attackMode bool
+var fixturesDir string
+var pruneWithDangerMap bool
+var planner string
+var beamWidth int
+var beamRoot *SearchNode
+var input io.Reader = os.Stdin
+
+/***** Recording and replay *****/
+
+// actions are interleaved with the raw input in the recordings
+const recordedActionPrefix = ">"
+
+// OpenRecording returns the input of a recorded game and the actions the bot played
+func OpenRecording(path string) (io.Reader, []string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var in strings.Builder
+	var actions []string
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if strings.HasPrefix(line, recordedActionPrefix) {
+			actions = append(actions, strings.TrimSpace(strings.TrimPrefix(line, recordedActionPrefix)))
+		} else {
+			in.WriteString(line)
+		}
+	}
+	return strings.NewReader(in.String()), actions, nil
+}
+
+/* the action of playerId from the previous state, read from the states
+ * themselves rather than from actionToGetHere */
+func (ga *GameArea) ActionOf(playerId int) Action {
+	action := Action{move, ga.players[playerId].Position}
+	from := ga.previous.players[playerId].Position
+	for _, bomb := range ga.droppedBombs {
+		if bomb.ownerID == playerId && bomb.Position == from && bomb.timer == bombTimer {
+			action.action = dropBomb
+		}
+	}
+	return action
+}
+
+func (ga *GameArea) PathFrom(root *GameArea) (path []Action) {
+	for state := ga; state != root && state.previous != nil; state = state.previous {
+		path = append(path, state.actionToGetHere)
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return
+}
 
 func main() {
+	flag.BoolVar(&opponentAware, "opponents", true, "check the worst case opponent bomb drops during the first turns of the search")
+	flag.BoolVar(&pruneWithDangerMap, "prune", true, "don't generate the moves from which no escape exists")
+	flag.BoolVar(&useTranspositions, "transpositions", true, "best-first search only expands the best of the states sharing a Zobrist hash")
+	flag.StringVar(&planner, "planner", "bestfirst", "search algorithm: bestfirst or beam (reuses the tree between turns)")
+	flag.IntVar(&beamWidth, "beamwidth", 300, "number of nodes kept at each depth by the beam planner")
+	flag.IntVar(&nbWorkers, "workers", runtime.NumCPU(), "number of goroutines of the best-first search")
+	refereeBots := flag.String("referee", "", "comma separated bot commands: referee matches between them instead of playing")
+	refereeMatches := flag.Int("matches", 100, "number of matches played by the referee")
+	refereeSeed := flag.Int64("seed", 1, "seed of the first map generated by the referee")
+	refereeTurnTime := flag.Duration("turntime", time.Second, "time limit of the bots for one turn, ten times more for the first one")
+	refereeWidth := flag.Int("width", nbCols, "number of columns of the maps generated by the referee")
+	refereeHeight := flag.Int("height", nbRows, "number of rows of the maps generated by the referee")
+	weightsFile := flag.String("weights", "", "JSON file of evaluation weights, overrides HYPERSONIC_WEIGHTS")
+	flag.StringVar(&fixturesDir, "fixtures", "", "directory where the turns the simulation got wrong are written")
+	recordFile := flag.String("record", "", "file where the input and the actions of the game are saved")
+	replayFile := flag.String("replay", "", "recorded game fed to the bot instead of stdin")
+	replayTurn := flag.Int("replayturn", -1, "turn of the replayed game at which the search is inspected, the last one by default")
+	flag.Parse()
+
+	if err := LoadEvalWeights(*weightsFile); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot load the evaluation weights: %v\n", err)
+	}
+	fmt.Fprintf(os.Stderr, "weights: %+v\n", evalWeights)
+
+	if *refereeBots != "" {
+		if err := SetGridSize(*refereeWidth, *refereeHeight); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot referee: %v\n", err)
+			return
+		}
+		if err := RunReferee(strings.Split(*refereeBots, ","), *refereeMatches, *refereeSeed, *refereeTurnTime); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot referee: %v\n", err)
+		}
+		return
+	}
+
+	var recorder *bufio.Writer
+	if *recordFile != "" {
+		f, err := os.Create(*recordFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot record the game: %v\n", err)
+		} else {
+			defer f.Close()
+			recorder = bufio.NewWriter(f)
+			input = io.TeeReader(os.Stdin, recorder)
+		}
+	}
+
+	var recordedActions []string
+	stderr := os.Stderr
+	if *replayFile != "" {
+		var err error
+		input, recordedActions, err = OpenRecording(*replayFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot replay the game: %v\n", err)
+			return
+		}
+		if *replayTurn < 0 || *replayTurn >= len(recordedActions) {
+			*replayTurn = len(recordedActions) - 1
+		}
+		if *replayTurn < 0 {
+			fmt.Fprintf(os.Stderr, "no turn recorded in %v\n", *replayFile)
+			return
+		}
+		// only the inspected turn is traced
+		if devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+			os.Stderr = devNull
+		}
+	}
 
-	var c Cell
+	var g Grid
+	c := g.CellAt(Position{0, 0})
 	i := 0
 
 	if false {
@@ -754,94 +1765,475 @@ func main() {
 	}
 
 	var width, height int
-	fmt.Scan(&width, &height, &me)
+	fmt.Fscan(input, &width, &height, &me)
+	if err := SetGridSize(width, height); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot play: %v\n", err)
+		return
+	}
 	var previous *GameArea = nil
+	var lastAction Action
 
 	for {
 
 		runtime.GC()
-		nbCritDead, nbCritSpt, nbCritPpt, nbCritTurn = 0, 0, 0, 0
 
 		currentGameArea = new(GameArea)
-		currentGameArea.previous = previous
 		currentGameArea.turn = turn
+		if recordedActions != nil && turn == *replayTurn {
+			os.Stderr = stderr
+		}
 
 		currentGameArea.acquire()
+		if previous == nil {
+			// the players of the game are the ones listed on the first turn
+			count := 0
+			for pidx, p := range currentGameArea.players {
+				if !p.isDead {
+					count = pidx + 1
+				}
+			}
+			if err := SetPlayerCount(count); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+			}
+		}
 
-		timeout = false
 		begin = time.Now()
+		ctx, cancel := context.WithDeadline(context.Background(), begin.Add(timeoutLimit*time.Millisecond))
 
-		if previous != nil { // test explosion
-			var simulatedCurrentGA GameArea = *previous
-			simulatedCurrentGA.previous = previous
-			cells := simulatedCurrentGA.ExplodeTimedOutBombs()
-			Diff(currentGameArea, &simulatedCurrentGA)
-			fmt.Fprintf(os.Stderr, "Burned cells: %v\n", cells)
-			for i := 0; i < maxPlayers; i++ {
-				currentGameArea.players[i].score = simulatedCurrentGA.players[i].score
-			}
+		if nbBoxes := currentGameArea.grid.boxes.Count(); !attackMode && nbBoxes < attackBoxThreshold {
+			attackMode = true
+			fmt.Fprintf(os.Stderr, "Attack mode: %v boxes left\n", nbBoxes)
 		}
 
-		queue := make(genHeap, 0, 1000)
-		queue.Push(currentGameArea)
-		heap.Init(&queue)
+		if previous != nil {
+			CheckTurn(previous, currentGameArea, lastAction)
+			// the scores are not given: carry them over
+			predicted := previous.PredictNext(currentGameArea)
+			for i := 0; i < nbPlayers; i++ {
+				currentGameArea.players[i].score = predicted.players[i].score
+			}
+		}
 
-		bestGameArea := currentGameArea
+		searchRoot := currentGameArea
+		var bestGameArea *GameArea // the search root can't be dangerous: only compare its children
+		var stats SearchStats
 		turnStats := make(map[int]int)
 
 		count := 0
+		remaining := 0
 
-		for len(queue) > 0 {
-			var currentGA *GameArea = heap.Pop(&queue).(*GameArea)
-			for _, state := range currentGA.GetNextStates(me) {
-				if !state.players[me].isDead {
-					heap.Push(&queue, state)
-					if state.IsBetterThan(bestGameArea) {
-						bestGameArea = state
-					}
-					turnStats[state.turn]++
-				}
-			}
-
-			count++
-			if count%100 == 0 {
-				elapsed := time.Since(begin)
-				//fmt.Fprintf(os.Stderr, "elapsed: %v\n", elapsed)
-				if elapsed > timeoutLimit*time.Millisecond {
-					timeout = true
-					fmt.Fprintf(os.Stderr, "elapsed: %v\n", elapsed)
-				}
+		if planner == "beam" {
+			if beamRoot != nil && beamRoot.ga.Matches(currentGameArea) {
+				fmt.Fprintf(os.Stderr, "Reusing search tree\n")
+				beamRoot.parent = nil
+			} else {
+				beamRoot = &SearchNode{ga: currentGameArea}
 			}
-
-			if timeout {
-				break
+			searchRoot = beamRoot.ga
+
+			stats.ctx = ctx
+			var bestNode *SearchNode
+			bestNode, count = BeamSearch(beamRoot, &stats, turnStats)
+			beamRoot = nil
+			if bestNode != nil {
+				bestGameArea = bestNode.ga
+				beamRoot = bestNode.FirstStep()
 			}
+		} else {
+			result := ParallelSearch(ctx, currentGameArea, nbWorkers)
+			bestGameArea = result.best
+			stats = result.stats
+			turnStats = result.turnStats
+			count = result.nbTreated
+			remaining = result.nbRemaining
+			fmt.Fprintf(os.Stderr, "transpositions=%v\n", result.nbTranspositions)
 		}
+		cancel()
+		currentGameArea.stats = nil // what follows isn't part of the search
+		fmt.Fprintf(os.Stderr, "generated=%v bombs=%v\n", stats.nbGeneratedStates, stats.nbBombsExploded)
 
 		pathLen := 0
 
+		if bestGameArea == nil {
+			bestGameArea = searchRoot
+		}
 		nextState := bestGameArea
 
-		if nextState != currentGameArea {
-			for nextState.previous != currentGameArea {
+		if nextState != searchRoot {
+			for nextState.previous != searchRoot {
 				nextState = nextState.previous
 				pathLen++
 			}
 		}
+		action := nextState.actionToGetHere
+		if nextState == searchRoot {
+			// nothing survives: stay there rather than heading to (0,0)
+			action = Action{move, currentGameArea.players[me].Position}
+		} else if checked := nextState.ActionOf(me); checked != action {
+			// the reused tree must not send a bomb the planner never chose
+			fmt.Fprintf(os.Stderr, "action %v doesn't lead to the next state, %v does\n", action, checked)
+			action = checked
+		}
 
 		fmt.Fprint(os.Stderr, currentGameArea)
+		fmt.Fprint(os.Stderr, currentGameArea.DangerMap())
 
-		fmt.Fprintf(os.Stderr, "PathLen=%v treated=%v remaining=%v\n", pathLen, count, len(queue))
-		fmt.Fprintf(os.Stderr, "crit d=%v spt=%v ppt=%v t=%v\n", nbCritDead, nbCritSpt, nbCritPpt, nbCritTurn)
+		fmt.Fprintf(os.Stderr, "PathLen=%v treated=%v remaining=%v\n", pathLen, count, remaining)
+		fmt.Fprintf(os.Stderr, "%v\n", stats)
 		fmt.Fprint(os.Stderr, bestGameArea)
 
 		for i := turn + 1; turnStats[i] > 0; i++ {
 			fmt.Fprintf(os.Stderr, "turn %v: %v\n", i, turnStats[i])
 		}
 
-		fmt.Printf("%v\n", nextState.actionToGetHere) // Write action to stdout
+		if recordedActions != nil {
+			if turn == *replayTurn {
+				fmt.Fprintf(os.Stderr, "best path: %v\n", bestGameArea.PathFrom(searchRoot))
+				fmt.Fprintf(os.Stderr, "recorded: %v replayed: %v\n", recordedActions[turn], action)
+				return
+			}
+			// replay what was played so that the checks follow the recorded game
+			if recorded, ok := ParseAction(recordedActions[turn]); ok {
+				action = recorded
+			}
+		} else {
+			fmt.Printf("%v\n", action) // Write action to stdout
+		}
+		if recorder != nil {
+			fmt.Fprintf(recorder, "%v%v\n", recordedActionPrefix, action)
+			recorder.Flush()
+		}
+		lastAction = action
 
 		previous = currentGameArea
 		turn++
 	}
 }
+
+/***** Local referee *****/
+
+const (
+	refereeMaxTurns      = 200
+	refereeTurnsAfterBox = 20 // the game goes on for this many turns once all boxes are destroyed
+)
+
+func StartPosition(pidx int) Position {
+	return [maxPlayers]Position{Position{0, 0}, Position{nbCols - 1, nbRows - 1}, Position{nbCols - 1, 0}, Position{0, nbRows - 1}}[pidx]
+}
+
+/* a bot process, talking the arena protocol on its stdin/stdout */
+type RefereeBot struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	lines   chan string
+	stopped chan struct{}
+}
+
+func StartBot(command string) (*RefereeBot, error) {
+	bot := &RefereeBot{cmd: exec.Command("sh", "-c", command), lines: make(chan string), stopped: make(chan struct{})}
+	var err error
+	if bot.stdin, err = bot.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	stdout, err := bot.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = bot.cmd.Start(); err != nil {
+		return nil, err
+	}
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		defer close(bot.lines)
+		for scanner.Scan() {
+			// nobody reads the lines of a stopped bot
+			select {
+			case bot.lines <- scanner.Text():
+			case <-bot.stopped:
+				return
+			}
+		}
+	}()
+	return bot, nil
+}
+
+func (bot *RefereeBot) ReadLine(timeLimit time.Duration) (string, bool) {
+	select {
+	case line, ok := <-bot.lines:
+		return line, ok
+	case <-time.After(timeLimit):
+		return "", false
+	}
+}
+
+func (bot *RefereeBot) Stop() {
+	close(bot.stopped)
+	bot.stdin.Close()
+	bot.cmd.Process.Kill()
+	bot.cmd.Wait()
+}
+
+// Symmetric random map: walls on odd cells, boxes everywhere else but around
+// the start positions.
+// Each cell of the top left quarter is mirrored on the other ones. On an even
+// size the middle column or row has its mirror next to it: no wall there, a
+// double wall would cut the map.
+func GenerateGameArea(rnd *rand.Rand) *GameArea {
+	ga := new(GameArea)
+	for y := 0; y < (nbRows+1)/2; y++ {
+		for x := 0; x < (nbCols+1)/2; x++ {
+			var mirrors []Position
+			for _, pos := range []Position{Position{x, y}, Position{nbCols - 1 - x, y}, Position{x, nbRows - 1 - y}, Position{nbCols - 1 - x, nbRows - 1 - y}} {
+				duplicate := false
+				for _, other := range mirrors {
+					duplicate = duplicate || other == pos
+				}
+				if !duplicate {
+					mirrors = append(mirrors, pos)
+				}
+			}
+			if x%2 == 1 && y%2 == 1 && nbCols-1-x != x+1 && nbRows-1-y != y+1 {
+				for _, pos := range mirrors {
+					ga.grid.CellAt(pos).SetWall()
+				}
+				continue
+			}
+			if x+y <= 1 || rnd.Intn(100) >= 60 {
+				continue
+			}
+			itemType := itemNone
+			switch r := rnd.Intn(100); {
+			case r < 20:
+				itemType = itemExtraRange
+			case r < 40:
+				itemType = itemExtraBomb
+			}
+			for _, pos := range mirrors {
+				ga.grid.CellAt(pos).SetBox(itemType)
+			}
+		}
+	}
+	for pidx := range ga.players {
+		if pidx < nbPlayers {
+			ga.players[pidx] = Player{Position: StartPosition(pidx), remainingBombs: 1, bombRange: 3}
+			ga.grid.CellAt(StartPosition(pidx)).SetPlayer(pidx)
+		} else {
+			ga.players[pidx].isDead = true
+		}
+	}
+	return ga
+}
+
+// Writes the turn input as GameArea.acquire reads it
+func (ga *GameArea) WriteInput(w io.Writer) {
+	var buffer bytes.Buffer
+	for y := 0; y < nbRows; y++ {
+		for x := 0; x < nbCols; x++ {
+			cell := ga.grid.CellAt(Position{x, y})
+			switch {
+			case cell.isWall():
+				buffer.WriteByte(wall)
+			case cell.isBox():
+				buffer.WriteByte(box + byte(cell.getItemType()))
+			default:
+				buffer.WriteByte(empty)
+			}
+		}
+		buffer.WriteByte('\n')
+	}
+	var entities []string
+	for pidx, p := range ga.players {
+		if !p.isDead {
+			entities = append(entities, fmt.Sprintf("%v %v %v %v %v %v", playerEntity, pidx, p.x, p.y, p.remainingBombs, p.bombRange))
+		}
+	}
+	for _, bomb := range ga.droppedBombs {
+		entities = append(entities, fmt.Sprintf("%v %v %v %v %v %v", bombEntity, bomb.ownerID, bomb.x, bomb.y, bomb.timer, bomb.bombRange))
+	}
+	for y := 0; y < nbRows; y++ {
+		for x := 0; x < nbCols; x++ {
+			if cell := ga.grid.CellAt(Position{x, y}); cell.isItem() {
+				entities = append(entities, fmt.Sprintf("%v %v %v %v %v %v", itemEntity, 0, x, y, cell.getItemType(), 0))
+			}
+		}
+	}
+	buffer.WriteString(fmt.Sprintf("%v\n", len(entities)))
+	for _, entity := range entities {
+		buffer.WriteString(entity + "\n")
+	}
+	w.Write(buffer.Bytes())
+}
+
+// First step of a shortest path toward target, or toward the reachable cell
+// closest to it when it can't be reached.
+func (ga *GameArea) StepToward(from, target Position) Position {
+	accessible := ga.grid.accessible()
+	parents := map[Position]Position{from: from}
+	queue := []Position{from}
+	closest := from
+	for len(queue) > 0 {
+		pos := queue[0]
+		queue = queue[1:]
+		if abs(pos.x-target.x)+abs(pos.y-target.y) < abs(closest.x-target.x)+abs(closest.y-target.y) {
+			closest = pos
+		}
+		for _, v := range cardinalVectors {
+			next := Add(pos, v)
+			if _, seen := parents[next]; !seen && next.IsOnGrid() && accessible.Has(next.index()) {
+				parents[next] = pos
+				queue = append(queue, next)
+			}
+		}
+	}
+	for parents[closest] != from {
+		closest = parents[closest]
+	}
+	return closest
+}
+
+// Plays one game between the bots, botOfPlayer[i] being the bot playing as
+// player i. Returns the final scores and the winner, -1 for a draw.
+func RefereeMatch(commands []string, botOfPlayer []int, seed int64, turnTime time.Duration) (scores []int, winner int) {
+	ga := GenerateGameArea(rand.New(rand.NewSource(seed)))
+
+	bots := make([]*RefereeBot, nbPlayers)
+	for pidx := range bots {
+		bot, err := StartBot(commands[botOfPlayer[pidx]])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot start %v: %v\n", commands[botOfPlayer[pidx]], err)
+			ga.players[pidx].isDead = true
+			continue
+		}
+		bots[pidx] = bot
+		defer bot.Stop()
+		fmt.Fprintf(bot.stdin, "%v %v %v\n", nbCols, nbRows, pidx)
+	}
+
+	lastBoxTurn := refereeMaxTurns
+	for ga.turn < refereeMaxTurns {
+		var actions [maxPlayers]Action
+		// all the bots think at the same time
+		for pidx, bot := range bots {
+			if !ga.players[pidx].isDead {
+				ga.WriteInput(bot.stdin)
+			}
+		}
+		for pidx, bot := range bots {
+			if ga.players[pidx].isDead {
+				continue
+			}
+			limit := turnTime
+			if ga.turn == 0 {
+				limit *= 10
+			}
+			line, ok := bot.ReadLine(limit)
+			if ok {
+				actions[pidx], ok = ParseAction(line)
+			}
+			if !ok {
+				fmt.Fprintf(os.Stderr, "turn %v: player %v timed out or sent %q\n", ga.turn, pidx, line)
+				ga.players[pidx].isDead = true
+				ga.grid.CellAt(ga.players[pidx].Position).ResetPlayer(pidx)
+				continue
+			}
+		}
+
+		// same order as the search: explosions, then new bombs, then moves
+		next := *ga
+		next.turn++
+		next.ExplodeTimedOutBombs()
+		for pidx := range bots {
+			p := next.players[pidx]
+			if p.isDead || ga.players[pidx].isDead {
+				continue
+			}
+			if actions[pidx].action == dropBomb && p.remainingBombs > 0 && next.grid.CellAt(p.Position).CanReceiveBombNow() {
+				next.DropBomb(pidx)
+			}
+		}
+		for pidx := range bots {
+			if !next.players[pidx].isDead {
+				next.MovePlayer(pidx, next.StepToward(next.players[pidx].Position, actions[pidx].pos))
+			}
+		}
+		*ga = next
+
+		nbAlive := 0
+		for pidx := range bots {
+			if !ga.players[pidx].isDead {
+				nbAlive++
+			}
+		}
+		if nbAlive <= 1 {
+			break
+		}
+		if ga.grid.boxes.IsZero() && lastBoxTurn == refereeMaxTurns {
+			lastBoxTurn = ga.turn
+		}
+		if ga.turn >= lastBoxTurn+refereeTurnsAfterBox {
+			break
+		}
+	}
+
+	// the survivors win over the dead, then the most boxes destroyed
+	candidates := make([]int, 0, nbPlayers)
+	for pidx := range bots {
+		scores = append(scores, ga.players[pidx].score)
+		if !ga.players[pidx].isDead {
+			candidates = append(candidates, pidx)
+		}
+	}
+	if len(candidates) == 0 {
+		for pidx := range bots {
+			candidates = append(candidates, pidx)
+		}
+	}
+	winner = candidates[0]
+	draw := false
+	for _, pidx := range candidates[1:] {
+		if scores[pidx] > scores[winner] {
+			winner, draw = pidx, false
+		} else if scores[pidx] == scores[winner] {
+			draw = true
+		}
+	}
+	if draw {
+		winner = -1
+	}
+	return
+}
+
+// Plays nbMatches games, rotating the start positions, and prints the results
+func RunReferee(commands []string, nbMatches int, seed int64, turnTime time.Duration) error {
+	if len(commands) < 2 {
+		return fmt.Errorf("%v bots, at least 2 needed", len(commands))
+	}
+	if err := SetPlayerCount(len(commands)); err != nil {
+		return err
+	}
+	wins := make([]int, nbPlayers)
+	draws := 0
+	for match := 0; match < nbMatches; match++ {
+		botOfPlayer := make([]int, nbPlayers)
+		for pidx := range botOfPlayer {
+			botOfPlayer[pidx] = (pidx + match) % nbPlayers
+		}
+		scores, winner := RefereeMatch(commands, botOfPlayer, seed+int64(match), turnTime)
+		botScores := make([]int, nbPlayers)
+		for pidx, score := range scores {
+			botScores[botOfPlayer[pidx]] = score
+		}
+		if winner < 0 {
+			draws++
+			fmt.Printf("match %v seed=%v draw scores=%v\n", match, seed+int64(match), botScores)
+		} else {
+			wins[botOfPlayer[winner]]++
+			fmt.Printf("match %v seed=%v winner=%v scores=%v\n", match, seed+int64(match), botOfPlayer[winner], botScores)
+		}
+	}
+	for bot, command := range commands {
+		fmt.Printf("bot %v (%v): %v wins (%.1f%%)\n", bot, command, wins[bot], 100*float64(wins[bot])/float64(nbMatches))
+	}
+	fmt.Printf("draws: %v\n", draws)
+	return nil
+}
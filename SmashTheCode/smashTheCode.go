@@ -1,10 +1,18 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"container/heap"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"os"
+	"os/exec"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -19,6 +27,16 @@ const (
 	skull        = '0'
 	nilColumn    = -1
 	maxRound     = 200
+	threatDepth  = 2                    // number of pairs over which the opponent moves are searched
+	chainBonus   = 6                    // potential per clearing step of the best chain ready to fire, beyond the first
+	nbCandidates = 16                   // best states of the search valued with rollouts
+	nbRollouts   = 4                    // random pair sequences played from each candidate, past the search
+	rolloutDepth = 4                    // random pairs of each rollout, after the known ones
+	rolloutLoss  = 1000                 // score counted for a rollout that found no room for a pair
+	rolloutScale = 40                   // score of the rollouts worth one point of potential
+	rolloutTime  = 5 * time.Millisecond // taken from the search time
+	nbMoves      = 4*nbCols - 2         // (col, rot) couples keeping the pair in the grid
+	finishLines  = 2                    // skull lines killing the opponent, below which we go for it
 )
 
 type Line [nbCols]byte
@@ -30,6 +48,9 @@ type PlayerArea struct {
 	dropCol      int //column at which the pair was just dropped
 	dropRotation int //rotation at which the pair was just dropped
 	potential    int
+	threatened   bool //would not survive the skull lines the opponent can send
+	collapses    bool //most of the rollouts past the search found no room
+	nuisance     int  //score not turned into skull lines yet, 70 per nuisance point
 }
 
 type Pair [2]byte
@@ -41,6 +62,10 @@ type GameArea struct {
 	previous   *GameArea
 }
 
+type Move struct {
+	col, rot int
+}
+
 type Coord struct {
 	row, col int
 }
@@ -53,12 +78,57 @@ type BigGroup struct {
 type State struct {
 	area     PlayerArea
 	step     int //from 0 to 7
-	previous *State
+	id       StateIndex
+	previous StateIndex
+}
+
+/* the states live in blocks reused from one round to the next:
+ * nothing to allocate nor to collect during the search */
+type StateIndex int32
+
+const (
+	noState        StateIndex = -1
+	stateBlockBits            = 12
+	stateBlockMask            = 1<<stateBlockBits - 1
+)
+
+type StatePool struct {
+	blocks   [][]State
+	nbStates int
+}
+
+var statePool StatePool
+
+func (p *StatePool) reset() {
+	p.nbStates = 0
+}
+
+func (p *StatePool) newState() *State {
+	block := p.nbStates >> stateBlockBits
+	if block == len(p.blocks) {
+		p.blocks = append(p.blocks, make([]State, 1<<stateBlockBits))
+	}
+	s := &p.blocks[block][p.nbStates&stateBlockMask]
+	*s = State{id: StateIndex(p.nbStates), previous: noState}
+	p.nbStates++
+	return s
+}
+
+func (p *StatePool) at(i StateIndex) *State {
+	return &p.blocks[i>>stateBlockBits][i&stateBlockMask]
+}
+
+func (s *State) parent() *State {
+	if s.previous == noState {
+		return nil
+	}
+	return statePool.at(s.previous)
 }
 
 type Stat struct {
 	nbGenerated  int
 	nbExpanded   int
+	nbDuplicates int
 	sumPotential uint64
 	sumScore     uint64
 	maxScore     int
@@ -73,6 +143,13 @@ var begin time.Time
 var debug bool
 var minAddScoreToWin int
 var minAcceptableAddScore int
+var phase Phase
+
+/* skull lines falling on our grid after our step i, cumulated over the steps.
+ * The lines made by a move fall after the next move of the opponent:
+ * the pending ones after our step 1, the ones made by his step i after our step i+1 */
+var skullLinesPending [nbPairsKnown + 1]int // already sent
+var skullLinesThreat [nbPairsKnown + 1]int  // he can send at most
 
 func currentGameArea() *GameArea {
 	return &gameHistory[currentRound]
@@ -156,7 +233,7 @@ func (s *State) Path() string {
 	nbSteps := 0
 	for state != nil {
 		grids[nbSteps] = strings.Split(fmt.Sprintf("%v %v\n", state.area.potential, state.step+1)+state.area.String(), "\n")
-		state = state.previous
+		state = state.parent()
 		nbSteps++
 	}
 
@@ -169,18 +246,51 @@ func (s *State) Path() string {
 	return buffer.String()
 }
 
+/* the remainder of the score carries over from one round to the next,
+ * only the full skull lines are dropped on the opponent */
+func (ga *GameArea) updateNuisance() {
+	if ga.previous == nil {
+		return
+	}
+	for player := range ga.playerArea {
+		previous := &ga.previous.playerArea[player]
+		ga.playerArea[player].nuisance = previous.nuisance%(nbCols*70) + ga.playerArea[player].score - previous.score
+	}
+}
+
 func (ga *GameArea) nuisanceAfterSkullDropFrom(player int) int {
-	return (ga.playerArea[player].score % (nbCols * 70)) / 70
+	return (ga.playerArea[player].nuisance % (nbCols * 70)) / 70
 }
 
 func (ga *GameArea) nuisanceBeforeSkullDropFrom(player int) int {
-	if ga.previous != nil {
-		previousScore := ga.previous.playerArea[player].score
-		score := ga.playerArea[player].score
-		return (score - previousScore + previousScore%(nbCols*70)) / 70
-	} else {
-		return 0
+	return ga.playerArea[player].nuisance / 70
+}
+
+/* searches the moves of player over the next threatDepth pairs
+ * and returns the skull lines he can send at most after each step */
+func (ga *GameArea) predictSkullLines(player int) (lines [nbPairsKnown + 1]int) {
+	initialState := statePool.newState()
+	initialState.area = ga.playerArea[player]
+	initialState.area.score = 0
+
+	var maxScores [threatDepth + 1]int
+	states := []*State{initialState}
+	for depth := 1; depth <= threatDepth; depth++ {
+		var nextStates []*State
+		for _, state := range states {
+			for _, nextState := range state.nextStates() {
+				nextStates = append(nextStates, nextState)
+				maxScores[depth] = Max(maxScores[depth], nextState.area.score)
+			}
+		}
+		states = nextStates
+	}
+
+	carry := ga.playerArea[player].nuisance % (nbCols * 70)
+	for step := 2; step <= nbPairsKnown; step++ {
+		lines[step] = (carry + maxScores[Min(step-1, threatDepth)]) / (nbCols * 70)
 	}
+	return
 }
 
 func (ga GameArea) String() string {
@@ -286,6 +396,32 @@ func (grid *Grid) fourWayExplore(c Coord, treated *Grid, groupCells *[]Coord, ma
 	}
 }
 
+/* same as fourWayExplore without recursion nor allocation:
+ * stores the group of c in cells and returns its size */
+func (grid *Grid) exploreGroup(c Coord, treated *Grid, cells []Coord, mark byte) int {
+	cells[0] = c
+	treated.SetCellAt(c, mark)
+	n := 1
+	around := [4]Coord{Coord{1, 0}, Coord{0, 1}, Coord{-1, 0}, Coord{0, -1}}
+	for i := 0; i < n; i++ {
+		for _, a := range around {
+			c2 := cells[i].Add(a)
+			if c2.isInGrid() && treated.CellAt(c2) == 0 && grid.CellAt(c2) == grid.CellAt(c) {
+				treated.SetCellAt(c2, mark)
+				cells[n] = c2
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func (grid *Grid) groupSize(c Coord) int {
+	var treated Grid
+	var cells [nbRows * nbCols]Coord
+	return grid.exploreGroup(c, &treated, cells[:], 'x')
+}
+
 func (grid *Grid) isIdenticalExceptTopSkullsTo(other *Grid) bool {
 	for col := 0; col < nbCols; col++ {
 		for row := nbRows - 1; row >= 0; row-- {
@@ -358,37 +494,42 @@ func (g *Grid) countEmpty() int {
 	return count
 }
 
-func (pa *PlayerArea) resolveAdjacents(dropCoords *[2]Coord, iteration uint) {
+/* returns the number of clearing steps of the chain */
+func (pa *PlayerArea) resolveAdjacents(dropCoords *[2]Coord, iteration uint) uint {
 	var treated Grid //0 = untreated
 
-	var bigGroups [][]Coord = make([][]Coord, 0, 4)
-	var smallGroups [][]Coord = make([][]Coord, 0, 10)
+	/* the groups are slices of cells: no allocation per group */
+	var cells [nbRows * nbCols]Coord
+	nbCells := 0
+	var bigGroups [nbRows * nbCols / 4][2]int // first and last+1 cell of the groups to clear
+	nbBigGroups := 0
 	var mark byte = 'a'
 
 	if dropCoords != nil {
 		for _, drop := range dropCoords {
-			var group []Coord = make([]Coord, 0, 6)
-			pa.grid.fourWayExplore(drop, &treated, &group, mark)
+			if treated.CellAt(drop) != 0 {
+				continue // both blocks in the same group
+			}
+			n := pa.grid.exploreGroup(drop, &treated, cells[nbCells:], mark)
 			mark++
-			if len(group) >= 4 {
-				bigGroups = append(bigGroups, group)
-			} else {
-				smallGroups = append(smallGroups, group)
+			if n >= 4 {
+				bigGroups[nbBigGroups] = [2]int{nbCells, nbCells + n}
+				nbBigGroups++
 			}
+			nbCells += n
 		}
 	} else {
 		/* try all cells */
 		for col := 0; col < nbCols; col++ {
 			for row := nbRows - 1; row >= 0 && !isEmpty(pa.grid[row][col]); row-- {
 				if treated[row][col] == 0 && isColor(pa.grid[row][col]) {
-					var group []Coord = make([]Coord, 0, 6)
-					pa.grid.fourWayExplore(Coord{row, col}, &treated, &group, mark)
+					n := pa.grid.exploreGroup(Coord{row, col}, &treated, cells[nbCells:], mark)
 					mark++
-					if len(group) >= 4 {
-						bigGroups = append(bigGroups, group)
-					} else {
-						smallGroups = append(smallGroups, group)
+					if n >= 4 {
+						bigGroups[nbBigGroups] = [2]int{nbCells, nbCells + n}
+						nbBigGroups++
 					}
+					nbCells += n
 				}
 			}
 		}
@@ -406,10 +547,10 @@ func (pa *PlayerArea) resolveAdjacents(dropCoords *[2]Coord, iteration uint) {
 			fmt.Fprintf(os.Stderr, "\n")
 		}
 
-		fmt.Fprintf(os.Stderr, "before clear:\n%v", pa)
+		fmt.Fprintf(os.Stderr, "before clear:\n%v", *pa)
 	}
 
-	if len(bigGroups) > 0 {
+	if nbBigGroups > 0 {
 		/* now clear the cells from big groups */
 		B := 0  /* Blocks cleared */
 		CP := 0 /* Chain Power */
@@ -419,7 +560,8 @@ func (pa *PlayerArea) resolveAdjacents(dropCoords *[2]Coord, iteration uint) {
 			CP = 1 << (iteration + 2) // 8, 16, 32, etc. 32 not observed
 		}
 		var colorCleared [6]bool
-		for _, group := range bigGroups {
+		for _, bounds := range bigGroups[:nbBigGroups] {
+			group := cells[bounds[0]:bounds[1]]
 			colorCleared[pa.grid.CellAt(group[0])-'0'] = true
 			for _, coord := range group {
 				pa.grid.ExplodeCellAt(coord)
@@ -450,8 +592,8 @@ func (pa *PlayerArea) resolveAdjacents(dropCoords *[2]Coord, iteration uint) {
 		if debug {
 			fmt.Fprintf(os.Stderr, "B=%v CP=%v CB=%v GB=%v coef=%v scoreAdd=%v\n",
 				B, CP, CB, GB, coef, (10*B)*coef)
-			fmt.Fprintf(os.Stderr, "bg=%v it=%v\n", len(bigGroups), iteration)
-			fmt.Fprintf(os.Stderr, "before Drop:\n%v", pa)
+			fmt.Fprintf(os.Stderr, "bg=%v it=%v\n", nbBigGroups, iteration)
+			fmt.Fprintf(os.Stderr, "before Drop:\n%v", *pa)
 		}
 
 		/* let above cells drop */
@@ -476,14 +618,84 @@ func (pa *PlayerArea) resolveAdjacents(dropCoords *[2]Coord, iteration uint) {
 		}
 
 		if debug {
-			fmt.Fprintf(os.Stderr, "after Drop:\n%v", pa)
+			fmt.Fprintf(os.Stderr, "after Drop:\n%v", *pa)
 		}
 		/* recursively test for new adjacent colors */
-		pa.resolveAdjacents(nil, iteration+1)
+		return pa.resolveAdjacents(nil, iteration+1)
 	}
+	return iteration
+}
+
+type Chain struct {
+	length   int
+	score    int
+	color    byte
+	col      int
+	nbBlocks int
+}
+
+func (c Chain) String() string {
+	return fmt.Sprintf("chain=%v score=%v (%v x%c in %v)", c.length, c.score, c.nbBlocks, c.color, c.col)
+}
+
+/* drops 1 or 2 blocks of each color in each column and keeps the longest chain,
+ * only the colors next to the landing cells can make a group */
+func (g *Grid) bestChain() (best Chain) {
+	around := [3]Coord{Coord{1, 0}, Coord{0, 1}, Coord{0, -1}}
+	for col := 0; col < nbCols; col++ {
+		if !isEmpty(g[0][col]) {
+			continue
+		}
+		row := g.lowestEmpty(col)
+		var candidates [6]bool
+		for nbBlocks := 1; nbBlocks <= 2 && row-nbBlocks+1 >= 0; nbBlocks++ {
+			for _, a := range around {
+				if c := (Coord{row - nbBlocks + 1, col}).Add(a); c.isInGrid() && isColor(g.CellAt(c)) {
+					candidates[g.CellAt(c)-'0'] = true
+				}
+			}
+			for color := byte('1'); color <= '5'; color++ {
+				if !candidates[color-'0'] {
+					continue
+				}
+				var pa PlayerArea
+				pa.grid = *g
+				coords := [2]Coord{Coord{row, col}, Coord{row - nbBlocks + 1, col}}
+				pa.grid.SetCellAt(coords[0], color)
+				pa.grid.SetCellAt(coords[1], color)
+				if pa.grid.groupSize(coords[0]) < 4 {
+					continue
+				}
+				length := int(pa.resolveAdjacents(&coords, 0))
+				if length > best.length || length == best.length && pa.score > best.score {
+					best = Chain{length, pa.score, color, col, nbBlocks}
+				}
+			}
+		}
+	}
+	return
 }
 
 func (pa *PlayerArea) computePotential() {
+	pa.potential = evaluator.potential(pa)
+}
+
+/***** Evaluation *****/
+
+type Evaluator interface {
+	potential(pa *PlayerArea) int
+}
+
+var evaluator Evaluator = heuristicEvaluator{}
+var useChains bool
+var useRollouts bool
+var rolloutRand *rand.Rand
+var searchTimeLimit time.Duration = 90 * time.Millisecond
+
+/* hand written: rewards the blocks of the same color close to each other */
+type heuristicEvaluator struct{}
+
+func (heuristicEvaluator) potential(pa *PlayerArea) int {
 	potential := 0
 
 	for col := 0; col < nbCols; col++ {
@@ -634,7 +846,134 @@ func (pa *PlayerArea) computePotential() {
 		}
 	}
 
-	pa.potential = potential
+	/* build chains on purpose rather than clearing greedily */
+	if !useChains {
+		return potential
+	}
+	if chain := pa.grid.bestChain(); chain.length > 1 {
+		potential += chainBonus * (chain.length - 1)
+	}
+
+	return potential
+}
+
+/* raw features of a grid, from which the weights of the learned evaluator are fitted */
+const (
+	featGroups    = 0                    // number of groups of 1, 2 and 3 blocks, per color
+	featHeights   = featGroups + 5*3     // height of each column
+	featSkulls    = featHeights + nbCols // number of skulls
+	featEmpty     = featSkulls + 1       // number of empty cells
+	featSetups    = featEmpty + 1        // groups of 3 blocks next to an empty cell: one block to clear them
+	featChain     = featSetups + 1       // length and score of the best chain ready to fire
+	nbFeatures    = featChain + 2
+	maxGroupCount = 3
+)
+
+type Features [nbFeatures]float64
+
+func (g *Grid) features() (f Features) {
+	var treated Grid
+	around := [4]Coord{Coord{1, 0}, Coord{0, 1}, Coord{-1, 0}, Coord{0, -1}}
+	for col := 0; col < nbCols; col++ {
+		height := 0
+		for row := nbRows - 1; row >= 0 && !isEmpty(g[row][col]); row-- {
+			height++
+			cell := g[row][col]
+			if isSkull(cell) {
+				f[featSkulls]++
+			} else if isColor(cell) && treated[row][col] == 0 {
+				var group []Coord = make([]Coord, 0, 6)
+				g.fourWayExplore(Coord{row, col}, &treated, &group, 'x')
+				size := Min(len(group), maxGroupCount)
+				f[featGroups+int(cell-'1')*maxGroupCount+size-1]++
+				if size == maxGroupCount {
+					setup := false
+					for _, c := range group {
+						for _, a := range around {
+							if c2 := c.Add(a); c2.isInGrid() && isEmpty(g.CellAt(c2)) {
+								setup = true
+							}
+						}
+					}
+					if setup {
+						f[featSetups]++
+					}
+				}
+			}
+		}
+		f[featHeights+col] = float64(height)
+		f[featEmpty] += float64(nbRows - height)
+	}
+	chain := g.bestChain()
+	f[featChain] = float64(chain.length)
+	f[featChain+1] = float64(chain.score)
+	return
+}
+
+func (f Features) String() string {
+	var buffer bytes.Buffer
+	for i, value := range f {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		buffer.WriteString(fmt.Sprintf("%v", value))
+	}
+	return buffer.String()
+}
+
+/* linear model of the features, with an optional hidden layer of ReLUs */
+type learnedEvaluator struct {
+	Hidden     [][]float64 // one row of nbFeatures weights per hidden unit
+	HiddenBias []float64
+	Output     []float64 // one weight per hidden unit, or per feature without hidden layer
+	Bias       float64
+}
+
+func loadLearnedEvaluator(path string) (*learnedEvaluator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	e := new(learnedEvaluator)
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, err
+	}
+	nbInputs := nbFeatures
+	if len(e.Hidden) > 0 {
+		for _, row := range e.Hidden {
+			if len(row) != nbFeatures {
+				return nil, fmt.Errorf("%v hidden weights instead of %v", len(row), nbFeatures)
+			}
+		}
+		if len(e.HiddenBias) != len(e.Hidden) {
+			return nil, fmt.Errorf("%v hidden biases instead of %v", len(e.HiddenBias), len(e.Hidden))
+		}
+		nbInputs = len(e.Hidden)
+	}
+	if len(e.Output) != nbInputs {
+		return nil, fmt.Errorf("%v output weights instead of %v", len(e.Output), nbInputs)
+	}
+	return e, nil
+}
+
+func (e *learnedEvaluator) potential(pa *PlayerArea) int {
+	features := pa.grid.features()
+	inputs := features[:]
+	if len(e.Hidden) > 0 {
+		inputs = make([]float64, len(e.Hidden))
+		for i, row := range e.Hidden {
+			sum := e.HiddenBias[i]
+			for j, w := range row {
+				sum += w * features[j]
+			}
+			inputs[i] = math.Max(sum, 0)
+		}
+	}
+	output := e.Bias
+	for i, w := range e.Output {
+		output += w * inputs[i]
+	}
+	return int(math.Round(output))
 }
 
 /* n >= 1 */
@@ -642,7 +981,7 @@ func (s *State) getNthState(n int) *State {
 	pathLen := 0
 	state := s
 	for state != nil {
-		state = state.previous
+		state = state.parent()
 		pathLen++
 	}
 
@@ -654,8 +993,8 @@ func (s *State) getNthState(n int) *State {
 	count := pathLen - n
 	for count > 0 {
 		count--
-		if state.previous != nil {
-			state = state.previous
+		if state.previous != noState {
+			state = state.parent()
 		}
 	}
 	return state
@@ -664,46 +1003,52 @@ func (s *State) getNthState(n int) *State {
 func (s *State) nextStates() []*State {
 	var nextStates []*State = make([]*State, 0, nbCols)
 	if s.step < nbPairsKnown {
-		for rot := 0; rot < 4; rot++ {
-			firstCol := 0
-			lastCol := nbCols
-			if rot == 2 {
-				firstCol = 1
-			}
-			if rot == 0 {
-				lastCol = nbCols - 1
-			}
-			for col := firstCol; col < lastCol; col++ {
-				/* do they fit? */
-				theyFit := true
-				switch rot {
-				case 0:
-					theyFit = isEmpty(s.area.grid[0][col]) && isEmpty(s.area.grid[0][col+1])
-				case 2:
-					theyFit = isEmpty(s.area.grid[0][col]) && isEmpty(s.area.grid[0][col-1])
-				case 1:
-					fallthrough
-				case 3:
-					theyFit = isEmpty(s.area.grid[1][col])
-				}
-
-				if theyFit {
-					nextStates = append(nextStates, s.nextState(col, rot))
-				}
-			}
+		var buffer [nbMoves]Move
+		for _, move := range s.area.grid.legalMoves(buffer[:0]) {
+			nextStates = append(nextStates, s.nextState(move.col, move.rot))
 		}
 	}
 	return nextStates
 }
 
-func (s *State) nextState(col, rot int) *State {
-	countNextState++
-	var next *State = new(State)
-	*next = *s
-	var coords [2]Coord
+/* do they fit? assumes the column is valid for the rotation */
+func (g *Grid) pairFits(col, rot int) bool {
+	switch rot {
+	case 0:
+		return isEmpty(g[0][col]) && isEmpty(g[0][col+1])
+	case 2:
+		return isEmpty(g[0][col]) && isEmpty(g[0][col-1])
+	default:
+		return isEmpty(g[1][col])
+	}
+}
 
+/* Both blocks have to be in the grid and the cells where the pair appears,
+ * on the top rows, have to be empty. The vertical pair appears on rows 0 and
+ * 1 of its column: the blocks fall, row 1 empty means row 0 empty too */
+func (g *Grid) isLegalMove(col, rot int) bool {
+	if col < 0 || col >= nbCols || rot < 0 || rot >= 4 || rot == 0 && col == nbCols-1 || rot == 2 && col == 0 {
+		return false
+	}
+	return g.pairFits(col, rot)
+}
+
+/* appends the legal moves to the buffer, by rotation then column */
+func (g *Grid) legalMoves(moves []Move) []Move {
+	for rot := 0; rot < 4; rot++ {
+		for col := 0; col < nbCols; col++ {
+			if g.isLegalMove(col, rot) {
+				moves = append(moves, Move{col, rot})
+			}
+		}
+	}
+	return moves
+}
+
+/* drops the pair and resolves the chain, returns where the two blocks landed */
+func (pa *PlayerArea) dropPair(pair Pair, col, rot int) (coords [2]Coord) {
 	if rot == 1 || rot == 3 {
-		dropDepth := next.area.grid.lowestEmpty(col)
+		dropDepth := pa.grid.lowestEmpty(col)
 		if rot == 1 {
 			coords[0] = Coord{dropDepth, col}
 			coords[1] = Coord{dropDepth - 1, col}
@@ -712,29 +1057,103 @@ func (s *State) nextState(col, rot int) *State {
 			coords[1] = Coord{dropDepth, col}
 		}
 	} else if rot == 0 {
-		coords[0] = Coord{next.area.grid.lowestEmpty(col), col}
-		coords[1] = Coord{next.area.grid.lowestEmpty(col + 1), col + 1}
+		coords[0] = Coord{pa.grid.lowestEmpty(col), col}
+		coords[1] = Coord{pa.grid.lowestEmpty(col + 1), col + 1}
 	} else {
-		coords[0] = Coord{next.area.grid.lowestEmpty(col), col}
-		coords[1] = Coord{next.area.grid.lowestEmpty(col - 1), col - 1}
+		coords[0] = Coord{pa.grid.lowestEmpty(col), col}
+		coords[1] = Coord{pa.grid.lowestEmpty(col - 1), col - 1}
 	}
 
 	/* Drop the two blocks */
-	next.area.grid[coords[0].row][coords[0].col] = currentGameArea().nextPairs[next.step][0]
-	next.area.grid[coords[1].row][coords[1].col] = currentGameArea().nextPairs[next.step][1]
+	pa.grid[coords[0].row][coords[0].col] = pair[0]
+	pa.grid[coords[1].row][coords[1].col] = pair[1]
 
-	next.area.resolveAdjacents(&coords, 0) // will compute the potential
+	pa.resolveAdjacents(&coords, 0)
+	return
+}
+
+/* plays the known pairs not dropped yet, then random pairs, with a greedy
+ * policy from a state of the search: returns the average score made and
+ * whether most of the rollouts found no room */
+func (pa *PlayerArea) rollout(known []Pair) (averageScore int, collapses bool) {
+	total, nbLost := 0, 0
+	for i := 0; i < nbRollouts; i++ {
+		area := *pa
+		area.score = 0
+		for depth := 0; depth < len(known)+rolloutDepth; depth++ {
+			var pair Pair
+			if depth < len(known) {
+				pair = known[depth]
+			} else {
+				pair = Pair{byte('1' + rolloutRand.Intn(5)), byte('1' + rolloutRand.Intn(5))}
+			}
+			var best PlayerArea
+			bestRows := -1
+			var buffer [nbMoves]Move
+			for _, move := range area.grid.legalMoves(buffer[:0]) {
+				next := area
+				coords := next.dropPair(pair, move.col, move.rot)
+				/* the highest score, then the lowest landing */
+				if rows := coords[0].row + coords[1].row; bestRows < 0 || next.score > best.score || next.score == best.score && rows > bestRows {
+					best = next
+					bestRows = rows
+				}
+			}
+			if bestRows < 0 {
+				nbLost++
+				total -= rolloutLoss
+				break
+			}
+			area = best
+		}
+		total += area.score
+	}
+	return total / nbRollouts, 2*nbLost > nbRollouts
+}
+
+/* the best state after the next pair alone, nil if it can't be played */
+func (s *State) bestNextState() (best *State) {
+	for _, next := range s.nextStates() {
+		if best == nil || next.isBetterThan(best) {
+			best = next
+		}
+	}
+	return
+}
+
+func (s *State) nextState(col, rot int) *State {
+	countNextState++
+	var next *State = statePool.newState()
+	id := next.id
+	*next = *s
+	next.id = id
+
+	next.area.dropPair(currentGameArea().nextPairs[next.step], col, rot)
 
 	next.step++
 	next.area.dropCol = col
 	next.area.dropRotation = rot
-	next.previous = s
+	next.previous = s.id
+
+	/* the skull lines already sent land after the pair */
+	nbPending := skullLinesPending[next.step] - skullLinesPending[s.step]
+	for i := 0; i < nbPending; i++ {
+		next.area.grid.dropOneSkullLine()
+	}
 	next.area.computePotential()
 
+	if nbLines := skullLinesThreat[next.step] - skullLinesPending[next.step]; nbLines > 0 || nbPending > 0 {
+		grid := next.area.grid
+		for i := 0; i < nbLines; i++ {
+			grid.dropOneSkullLine()
+		}
+		next.area.threatened = grid.willLooseForSure()
+	}
+
 	if countNextState%200 == 0 {
 		elapsed := time.Since(begin)
 		//fmt.Fprintf(os.Stderr, "elapsed: %v countNextState=%v \n", elapsed, countNextState)
-		if elapsed > 90*time.Millisecond {
+		if elapsed > searchTimeLimit {
 			timeout = true
 		}
 	}
@@ -757,7 +1176,58 @@ func Max(a, b int) int {
 	}
 }
 
+/* the strategy of the round, deciding how the states are compared */
+type Phase int
+
+const (
+	build    Phase = iota // room to grow the chains, only the big ones are fired
+	pressure              // fire as soon as it makes a skull line
+	defend                // our grid is full: free cells
+	finish                // he is close to death: send him the last lines
+)
+
+func (p Phase) String() string {
+	return [...]string{"build", "pressure", "defend", "finish"}[p]
+}
+
+/* from the empty cells of both grids and the skull lines, returns the phase and why */
+func choosePhase(ourEmpty, hisEmpty, linesComing, linesToKill int) (Phase, string) {
+	switch {
+	case linesToKill <= finishLines:
+		return finish, fmt.Sprintf("he dies with %v skull lines", linesToKill)
+	case ourEmpty-linesComing*nbCols < 4*nbCols:
+		return defend, fmt.Sprintf("%v empty cells, %v skull lines coming", ourEmpty, linesComing)
+	case ourEmpty < 6*nbCols:
+		return pressure, fmt.Sprintf("%v empty cells", ourEmpty)
+	case hisEmpty < ourEmpty-2*nbCols:
+		return pressure, fmt.Sprintf("he has %v empty cells, we have %v", hisEmpty, ourEmpty)
+	default:
+		return build, fmt.Sprintf("%v empty cells", ourEmpty)
+	}
+}
+
 func (s *State) isBetterThan(other *State) bool {
+	if s.area.threatened != other.area.threatened {
+		return !s.area.threatened
+	}
+	if s.area.collapses != other.area.collapses {
+		return !s.area.collapses
+	}
+	switch phase {
+	case defend:
+		return s.isSaferThan(other)
+	case finish:
+		return s.killsFasterThan(other)
+	case pressure:
+		return s.pressesBetterThan(other)
+	default:
+		return s.buildsBetterThan(other)
+	}
+}
+
+/* the potential grows until a combo reaches minAcceptableAddScore, two skull
+ * lines: the smaller ones are not worth the cells they free */
+func (s *State) buildsBetterThan(other *State) bool {
 	score1 := s.area.score
 	score2 := other.area.score
 	targetScore := Min(minAddScoreToWin, 2600)
@@ -790,25 +1260,263 @@ func (s *State) isBetterThan(other *State) bool {
 	}
 }
 
+/* any skull line is worth firing: the most lines per step first, the
+ * potential only between the states sending none */
+func (s *State) pressesBetterThan(other *State) bool {
+	fires1 := s.area.score >= minAcceptableAddScore
+	fires2 := other.area.score >= minAcceptableAddScore
+	if fires1 != fires2 {
+		return fires1
+	}
+	if fires1 {
+		targetScore := Min(minAddScoreToWin, 2600)
+		crit1 := Min(s.area.score, targetScore) - 70*nbCols*s.step
+		crit2 := Min(other.area.score, targetScore) - 70*nbCols*other.step
+		if crit1 != crit2 {
+			return crit1 > crit2
+		}
+		return s.area.potential > other.area.potential
+	}
+	if s.area.potential != other.area.potential {
+		return s.area.potential > other.area.potential
+	}
+	return s.step > other.step
+}
+
+/* the most cells freed for the pairs played, then the score sent back */
+func (s *State) isSaferThan(other *State) bool {
+	free1 := s.area.grid.countEmpty() + 2*s.step
+	free2 := other.area.grid.countEmpty() + 2*other.step
+	if free1 != free2 {
+		return free1 > free2
+	}
+	if s.area.score != other.area.score {
+		return s.area.score > other.area.score
+	}
+	return s.area.potential > other.area.potential
+}
+
+/* the lines killing him in the fewest steps, else the most lines per step */
+func (s *State) killsFasterThan(other *State) bool {
+	kills1 := s.area.score >= minAddScoreToWin
+	kills2 := other.area.score >= minAddScoreToWin
+	if kills1 && kills2 && s.step != other.step {
+		return s.step < other.step
+	}
+	if kills1 != kills2 {
+		return kills1
+	}
+	crit1 := Min(s.area.score, minAddScoreToWin) - 70*nbCols*s.step
+	crit2 := Min(other.area.score, minAddScoreToWin) - 70*nbCols*other.step
+	if crit1 != crit2 {
+		return crit1 > crit2
+	}
+	return s.area.potential > other.area.potential
+}
+
 func (s *State) hasToBeTreatedBefore(other *State) bool {
 	return s.area.potential > other.area.potential
 }
 
-type genHeap []*State
+/* the best states found by the search, best first */
+type Candidates []*State
 
-func (h genHeap) Len() int            { return len(h) }
-func (h genHeap) Less(i, j int) bool  { return h[i].hasToBeTreatedBefore(h[j]) }
-func (h genHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
-func (h *genHeap) Push(x interface{}) { *h = append(*h, x.(*State)) }
-func (h *genHeap) Pop() interface{} {
-	old := *h
-	n := len(old)
-	x := old[n-1]
-	*h = old[0 : n-1]
-	return x
+func (c *Candidates) offer(state *State) {
+	n := len(*c)
+	if n == nbCandidates && !state.isBetterThan((*c)[n-1]) {
+		return
+	}
+	i := sort.Search(n, func(i int) bool { return state.isBetterThan((*c)[i]) })
+	*c = append(*c, nil)
+	copy((*c)[i+1:], (*c)[i:])
+	(*c)[i] = state
+	if len(*c) > nbCandidates {
+		*c = (*c)[:nbCandidates]
+	}
+}
+
+/* values the candidates with rollouts and returns the best of them, nil
+ * without candidates */
+func (c Candidates) best() (best *State) {
+	for _, state := range c {
+		score, collapses := state.area.rollout(currentGameArea().nextPairs[state.step:])
+		state.area.potential += score / rolloutScale
+		state.area.collapses = collapses
+		if best == nil || state.isBetterThan(best) {
+			best = state
+		}
+	}
+	return best
+}
+
+/* the widths of the beam search, by depth: the last one is used for the
+ * deeper ones. Empty: the heaps are searched until the time is out */
+var beamWidths []int
+
+/* stops the beam search when the time is out, at the cost of its determinism */
+var beamTimeCut bool
+
+func parseBeamWidths(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var widths []int
+	for _, field := range strings.Split(s, ",") {
+		width, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || width <= 0 {
+			return nil, fmt.Errorf("bad beam width %q", field)
+		}
+		widths = append(widths, width)
+	}
+	return widths, nil
+}
+
+func beamWidth(depth int) int {
+	if depth < len(beamWidths) {
+		return beamWidths[depth]
+	}
+	return beamWidths[len(beamWidths)-1]
+}
+
+/* Expands every state of a depth and keeps the best ones for the next depth,
+ * each grid only once. The same input always gives the same move, whatever
+ * the speed of the machine, unless beamTimeCut stops the search in the middle
+ * of a depth with the best state found so far. Returns nil when no pair can
+ * be played */
+func beamSearch(initialState *State, stats *[nbPairsKnown + 1]Stat, candidates *Candidates) (bestState *State) {
+	beam := []*State{initialState}
+	for depth := 0; depth < nbPairsKnown && len(beam) > 0; depth++ {
+		var next []*State
+		seen := make(map[Grid]int, len(beam)*nbCols)
+		for i, state := range beam {
+			if beamTimeCut && timeout {
+				fmt.Fprintf(os.Stderr, "beam search out of time at depth %v, %v/%v states expanded\n", depth, i, len(beam))
+				return
+			}
+			stats[depth].nbExpanded++
+			for _, nextState := range state.nextStates() {
+				stats[depth+1].update(nextState)
+				if bestState == nil || nextState.isBetterThan(bestState) {
+					bestState = nextState
+				}
+				if useRollouts {
+					candidates.offer(nextState)
+				}
+				if i, ok := seen[nextState.area.grid]; ok {
+					stats[depth+1].nbDuplicates++
+					if nextState.isBetterThan(next[i]) {
+						next[i] = nextState
+					}
+					continue
+				}
+				seen[nextState.area.grid] = len(next)
+				next = append(next, nextState)
+			}
+		}
+		/* same order as the heaps: the best ones to build on, not to stop at */
+		sort.SliceStable(next, func(i, j int) bool { return next[i].hasToBeTreatedBefore(next[j]) })
+		if width := beamWidth(depth); len(next) > width {
+			next = next[:width]
+		}
+		beam = next
+	}
+	return
+}
+
+/* the states of one step, the one to treat first on top: typed rather than
+ * through container/heap, whose interface{} would allocate at each push */
+type genHeap []StateIndex
+
+func (h genHeap) less(i, j int) bool {
+	return statePool.at(h[i]).hasToBeTreatedBefore(statePool.at(h[j]))
+}
+
+func (h *genHeap) push(id StateIndex) {
+	*h = append(*h, id)
+	q := *h
+	for i := len(q) - 1; i > 0; {
+		parent := (i - 1) / 2
+		if !q.less(i, parent) {
+			break
+		}
+		q[i], q[parent] = q[parent], q[i]
+		i = parent
+	}
+}
+
+func (h *genHeap) pop() StateIndex {
+	q := *h
+	top := q[0]
+	n := len(q) - 1
+	q[0] = q[n]
+	q = q[:n]
+	for i := 0; ; {
+		first := i
+		if left := 2*i + 1; left < n && q.less(left, first) {
+			first = left
+		}
+		if right := 2*i + 2; right < n && q.less(right, first) {
+			first = right
+		}
+		if first == i {
+			break
+		}
+		q[i], q[first] = q[first], q[i]
+		i = first
+	}
+	*h = q
+	return top
 }
 
 func main() {
+	weightsFile := flag.String("weights", os.Getenv("SMASH_WEIGHTS"), "JSON weights of the learned evaluator, the hand written one is used without")
+	flag.BoolVar(&useChains, "chains", true, "reward the chains ready to fire, at the cost of fewer states searched")
+	flag.BoolVar(&useRollouts, "rollouts", true, "value the best states of the search with random pairs played past them")
+	beam := flag.String("beam", "", "comma separated widths of the beam search by depth, the last one for the deeper ones, e.g. 15 which fits in the time of a turn with the chains; empty to search the heaps until the time is out")
+	flag.BoolVar(&beamTimeCut, "beamtime", false, "stop the beam search when the time is out: the move then depends on the speed of the machine")
+	featuresFile := flag.String("features", "", "CSV file where the referee appends the features of both grids every round, with the result of the game")
+	refereeBots := flag.String("referee", "", "two comma separated bot commands: referee matches between them instead of playing")
+	refereeMatches := flag.Int("matches", 100, "number of matches played by the referee")
+	refereeSeed := flag.Int64("seed", 1, "seed of the pairs of the first match")
+	refereeTurnTime := flag.Duration("turntime", 100*time.Millisecond, "time limit of the bots for one turn, ten times more for the first one")
+	flag.Parse()
+
+	var featuresOut io.Writer
+	if *featuresFile != "" {
+		if file, err := os.OpenFile(*featuresFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot write the features: %v\n", err)
+		} else {
+			defer file.Close()
+			featuresOut = file
+		}
+	}
+
+	if *refereeBots != "" {
+		commands := strings.Split(*refereeBots, ",")
+		if len(commands) != 2 {
+			fmt.Fprintf(os.Stderr, "the referee needs two bots, not %v\n", len(commands))
+			return
+		}
+		RunReferee(commands, *refereeMatches, *refereeSeed, *refereeTurnTime, featuresOut)
+		return
+	}
+
+	var err error
+	if beamWidths, err = parseBeamWidths(*beam); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+	if *weightsFile != "" {
+		if learned, err := loadLearnedEvaluator(*weightsFile); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot load the weights: %v\n", err)
+		} else {
+			evaluator = learned
+		}
+	}
+	if useRollouts {
+		searchTimeLimit -= rolloutTime
+	}
+
 	currentRound = 0
 	addScore := 0
 	for {
@@ -818,11 +1526,19 @@ func main() {
 
 		currentGameArea().acquire()
 		begin = time.Now()
+		statePool.reset()
+		rolloutRand = rand.New(rand.NewSource(int64(currentRound)))
+
+		/* the simulations of the opponent don't receive skulls */
+		skullLinesPending = [nbPairsKnown + 1]int{}
+		skullLinesThreat = [nbPairsKnown + 1]int{}
 
 		if currentGameArea().previous != nil {
 			currentGameArea().playerArea[me].score = currentGameArea().previous.playerArea[me].score
 			currentGameArea().playerArea[me].score += addScore
-			var previousEnnemyState State
+			/* no match: he didn't score */
+			currentGameArea().playerArea[him].score = currentGameArea().previous.playerArea[him].score
+			previousEnnemyState := statePool.newState()
 			previousEnnemyState.area = currentGameArea().previous.playerArea[him]
 			currentRound--
 			currenPossibleEnnemyStates := previousEnnemyState.nextStates()
@@ -837,6 +1553,9 @@ func main() {
 			}
 		}
 
+		/* the input doesn't give the scores: his one is still inferred from his grid */
+		currentGameArea().updateNuisance()
+
 		ennemyGrid := currentGameArea().playerArea[him].grid
 		nbSkullLines := 0
 
@@ -847,23 +1566,39 @@ func main() {
 
 		additionalNuisanceNeededToWin := nbSkullLines*nbCols - currentGameArea().nuisanceAfterSkullDropFrom(me)
 		minAddScoreToWin = additionalNuisanceNeededToWin * 70
-		minToSkull := 70*nbCols - currentGameArea().playerArea[me].score%(70*nbCols)
+		minToSkull := 70*nbCols - currentGameArea().playerArea[me].nuisance%(70*nbCols)
 
 		nbEmpty := currentGameArea().playerArea[me].grid.countEmpty()
+		pendingLines := currentGameArea().nuisanceBeforeSkullDropFrom(him) / nbCols
 
-		if nbEmpty < 4*nbCols {
-			minAcceptableAddScore = 0
-		} else if nbEmpty < 6*nbCols {
-			minAcceptableAddScore = minToSkull
-		} else {
+		newPhase, reason := choosePhase(nbEmpty, currentGameArea().playerArea[him].grid.countEmpty(), pendingLines, nbSkullLines)
+		if newPhase != phase || currentRound == 0 {
+			fmt.Fprintf(os.Stderr, "phase %v -> %v: %v\n", phase, newPhase, reason)
+			phase = newPhase
+		}
+
+		switch phase {
+		case build:
 			minAcceptableAddScore = minToSkull + 70*nbCols //2 skull lines
+		case pressure, finish:
+			minAcceptableAddScore = minToSkull
+		case defend:
+			minAcceptableAddScore = 0
 		}
 
 		fmt.Fprintf(os.Stderr, "minAddScoreToWin=%v\n", minAddScoreToWin)
 		fmt.Fprintf(os.Stderr, "minAcceptableAddScore=%v\n", minAcceptableAddScore)
+
+		skullLinesThreat = currentGameArea().predictSkullLines(him)
+		for step := 1; step <= nbPairsKnown; step++ {
+			skullLinesPending[step] = pendingLines
+			skullLinesThreat[step] += pendingLines
+		}
+		fmt.Fprintf(os.Stderr, "skullLinesPending=%v skullLinesThreat=%v\n", skullLinesPending, skullLinesThreat)
+		fmt.Fprintf(os.Stderr, "%v\n", currentGameArea().playerArea[me].grid.bestChain())
 		//fmt.Fprintln(os.Stderr, currentGameArea())
 
-		var initialState *State = new(State)
+		var initialState *State = statePool.newState()
 		initialState.area = currentGameArea().playerArea[me]
 		initialState.area.score = 0
 
@@ -876,17 +1611,20 @@ func main() {
 			queues[i] = make(genHeap, 0, 1000)
 		}
 
-		queues[0].Push(initialState)
+		queues[0].push(initialState.id)
 		stats[0].update(initialState)
 
-		for i := 0; i < nbPairsKnown+1; i++ {
-			heap.Init(&queues[i])
-		}
-
 		var workingState *State
-		var bestState *State = initialState
+		/* only the generated states compete: the initial one is never
+		 * threatened, it would beat all of them when they all are */
+		var bestState *State
+		var candidates Candidates
 
 		minStep := 0
+		if beamWidths != nil {
+			bestState = beamSearch(initialState, &stats, &candidates)
+			minStep = nbPairsKnown + 1
+		}
 
 		for minStep < nbPairsKnown+1 && !timeout {
 			for i := minStep; i < nbPairsKnown+1 && !timeout; i++ {
@@ -897,47 +1635,61 @@ func main() {
 					continue
 				}
 
-				workingState = heap.Pop(&queues[i]).(*State)
+				workingState = statePool.at(queues[i].pop())
 				stats[i].nbExpanded++
 				nextStates := workingState.nextStates()
 				for _, nextState := range nextStates {
 					if i < nbPairsKnown {
-						heap.Push(&queues[i+1], nextState)
+						queues[i+1].push(nextState.id)
 						stats[i+1].update(nextState)
 					}
-					if nextState.isBetterThan(bestState) {
+					if bestState == nil || nextState.isBetterThan(bestState) {
 						bestState = nextState
 					}
+					if useRollouts {
+						candidates.offer(nextState)
+					}
 				}
 			}
 		}
 
+		if useRollouts && len(candidates) > 0 {
+			bestState = candidates.best()
+		}
+		if bestState == nil {
+			// no move exists
+			bestState = initialState
+		}
+
 		elapsed := time.Since(begin)
 		fmt.Fprintf(os.Stderr, "elapsed: %v countNextState=%v\n", elapsed, countNextState)
 
 		// Stats
 		for i := 0; i < nbPairsKnown+1; i++ {
-			fmt.Fprintf(os.Stderr, "[%v] max=%v exp=%v/%v avpot=%v avscore=%v\n",
-				i, stats[i].maxScore, stats[i].nbExpanded, stats[i].nbGenerated, stats[i].averagePotential(), stats[i].averageScore())
+			fmt.Fprintf(os.Stderr, "[%v] max=%v exp=%v/%v dup=%v avpot=%v avscore=%v\n",
+				i, stats[i].maxScore, stats[i].nbExpanded, stats[i].nbGenerated, stats[i].nbDuplicates, stats[i].averagePotential(), stats[i].averageScore())
 		}
 		fmt.Fprintln(os.Stderr, bestState.Path())
 
 		nextState := bestState.getNthState(2)
+		if nextState == initialState || !initialState.area.grid.isLegalMove(nextState.area.dropCol, nextState.area.dropRotation) {
+			fmt.Fprintln(os.Stderr, "no legal move from the search")
+			if fallback := initialState.bestNextState(); fallback != nil {
+				nextState = fallback
+			}
+		}
 		solutionCol := nextState.area.dropCol
 		solutionRot := nextState.area.dropRotation
+		if nextState == initialState {
+			// no room left: the game is lost, but the answer must still be a move
+			solutionCol, solutionRot = 0, 0
+		}
 
 		debug = false
 		if debug && solutionCol >= 0 {
 			bestState.getNthState(1).nextState(solutionCol, solutionRot)
 		}
 
-		if solutionCol < 0 || solutionCol >= nbCols {
-			solutionCol = 0
-		}
-		if solutionRot < 0 || solutionRot >= 4 {
-			solutionRot = 0
-		}
-
 		addScore = nextState.area.score - initialState.area.score
 		var text string
 		if addScore > 2000 {
@@ -956,3 +1708,216 @@ func main() {
 		currentRound++
 	}
 }
+
+/***** Local referee *****/
+
+/* a bot process, talking the arena protocol on its stdin/stdout */
+type RefereeBot struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	lines   chan string
+	stopped chan struct{}
+}
+
+func StartBot(command string) (*RefereeBot, error) {
+	bot := &RefereeBot{cmd: exec.Command("sh", "-c", command), lines: make(chan string), stopped: make(chan struct{})}
+	var err error
+	if bot.stdin, err = bot.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	stdout, err := bot.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = bot.cmd.Start(); err != nil {
+		return nil, err
+	}
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		defer close(bot.lines)
+		for scanner.Scan() {
+			// nobody reads the lines of a stopped bot
+			select {
+			case bot.lines <- scanner.Text():
+			case <-bot.stopped:
+				return
+			}
+		}
+	}()
+	return bot, nil
+}
+
+func (bot *RefereeBot) ReadLine(timeLimit time.Duration) (string, bool) {
+	select {
+	case line, ok := <-bot.lines:
+		return line, ok
+	case <-time.After(timeLimit):
+		return "", false
+	}
+}
+
+func (bot *RefereeBot) Stop() {
+	close(bot.stopped)
+	bot.stdin.Close()
+	bot.cmd.Process.Kill()
+	bot.cmd.Wait()
+}
+
+/* both players get the same pairs */
+func generatePairs(rnd *rand.Rand, nbPairs int) []Pair {
+	pairs := make([]Pair, nbPairs)
+	for i := range pairs {
+		pairs[i] = Pair{byte('1' + rnd.Intn(5)), byte('1' + rnd.Intn(5))}
+	}
+	return pairs
+}
+
+/* writes the turn input as GameArea.acquire reads it */
+func writeInput(w io.Writer, pairs []Pair, own, other *Grid) {
+	var buffer bytes.Buffer
+	for _, pair := range pairs {
+		buffer.WriteString(fmt.Sprintf("%c %c\n", pair[0], pair[1]))
+	}
+	buffer.WriteString(own.String())
+	buffer.WriteString(other.String())
+	w.Write(buffer.Bytes())
+}
+
+/* reads "col rot", anything after is a comment */
+func parseMove(line string, grid *Grid) (col, rot int, ok bool) {
+	if _, err := fmt.Sscan(line, &col, &rot); err != nil {
+		return 0, 0, false
+	}
+	return col, rot, grid.isLegalMove(col, rot)
+}
+
+/* Plays one game between the bots, botOfPlayer[i] being the bot playing as
+ * player i. Returns the final scores and the winner, -1 for a draw.
+ * The skull lines made by a move fall after the next move of the opponent.
+ * When featuresOut is not nil, the features of both grids are written there
+ * at the end of the game, one row per round and player, labelled with the
+ * result of the game for that player: 1 won, 0 lost, 0.5 draw. */
+func RefereeMatch(commands []string, botOfPlayer []int, seed int64, turnTime time.Duration, featuresOut io.Writer) (scores []int, winner int) {
+	pairs := generatePairs(rand.New(rand.NewSource(seed)), maxRound+nbPairsKnown)
+	var areas [2]PlayerArea
+	var lost [2]bool
+	var pendingLines [2]int // falling on the player after his next move
+	var features [][2]Features
+	var roundScores [][2]int
+	for player := range areas {
+		for row := 0; row < nbRows; row++ {
+			for col := 0; col < nbCols; col++ {
+				areas[player].grid[row][col] = empty
+			}
+		}
+	}
+
+	bots := make([]*RefereeBot, 2)
+	for player := range bots {
+		bot, err := StartBot(commands[botOfPlayer[player]])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot start %v: %v\n", commands[botOfPlayer[player]], err)
+			lost[player] = true
+			continue
+		}
+		bots[player] = bot
+		defer bot.Stop()
+	}
+
+	for round := 0; round < maxRound && !lost[0] && !lost[1]; round++ {
+		// both bots think at the same time
+		for player, bot := range bots {
+			writeInput(bot.stdin, pairs[round:round+nbPairsKnown], &areas[player].grid, &areas[1-player].grid)
+		}
+		if featuresOut != nil {
+			features = append(features, [2]Features{areas[0].grid.features(), areas[1].grid.features()})
+			roundScores = append(roundScores, [2]int{areas[0].score, areas[1].score})
+		}
+		for player, bot := range bots {
+			limit := turnTime
+			if round == 0 {
+				limit *= 10
+			}
+			line, ok := bot.ReadLine(limit)
+			var col, rot int
+			if ok {
+				col, rot, ok = parseMove(line, &areas[player].grid)
+			}
+			if !ok {
+				fmt.Fprintf(os.Stderr, "round %v: player %v timed out or can't play %q\n", round, player, line)
+				lost[player] = true
+				continue
+			}
+			previousScore := areas[player].score
+			areas[player].dropPair(pairs[round], col, rot)
+			areas[player].nuisance += areas[player].score - previousScore
+		}
+
+		for player := range areas {
+			for i := 0; i < pendingLines[player]; i++ {
+				areas[player].grid.dropOneSkullLine()
+			}
+		}
+		for player := range areas {
+			/* only the full lines are sent, the remainder carries over */
+			lines := areas[player].nuisance / (nbCols * 70)
+			areas[player].nuisance -= lines * nbCols * 70
+			pendingLines[1-player] = lines
+		}
+	}
+
+	scores = []int{areas[0].score, areas[1].score}
+	switch {
+	case lost[0] && lost[1]:
+		winner = -1
+	case lost[0]:
+		winner = 1
+	case lost[1]:
+		winner = 0
+	case scores[0] != scores[1]:
+		winner = 0
+		if scores[1] > scores[0] {
+			winner = 1
+		}
+	default:
+		winner = -1
+	}
+
+	for round := range features {
+		for player := range areas {
+			result := 0.5
+			if winner >= 0 {
+				result = 0
+				if winner == player {
+					result = 1
+				}
+			}
+			fmt.Fprintf(featuresOut, "%v,%v,%v,%v,%v,%v\n", seed, round, player, roundScores[round][player], result, features[round][player])
+		}
+	}
+	return
+}
+
+func RunReferee(commands []string, nbMatches int, seed int64, turnTime time.Duration, featuresOut io.Writer) {
+	wins := make([]int, len(commands))
+	draws := 0
+	for match := 0; match < nbMatches; match++ {
+		botOfPlayer := []int{match % 2, 1 - match%2}
+		scores, winner := RefereeMatch(commands, botOfPlayer, seed+int64(match), turnTime, featuresOut)
+		botScores := make([]int, 2)
+		for player, score := range scores {
+			botScores[botOfPlayer[player]] = score
+		}
+		if winner < 0 {
+			draws++
+			fmt.Printf("match %v seed=%v draw scores=%v\n", match, seed+int64(match), botScores)
+		} else {
+			wins[botOfPlayer[winner]]++
+			fmt.Printf("match %v seed=%v winner=%v scores=%v\n", match, seed+int64(match), botOfPlayer[winner], botScores)
+		}
+	}
+	for bot, command := range commands {
+		fmt.Printf("bot %v (%v): %v wins (%.1f%%)\n", bot, command, wins[bot], 100*float64(wins[bot])/float64(nbMatches))
+	}
+	fmt.Printf("draws: %v\n", draws)
+}